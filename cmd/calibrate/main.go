@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math"
+	"nature-id-api/internal/calibration"
+	"os"
+)
+
+// calibrate fits the temperature of a model from its outputs on a labeled validation set, one JSON
+// sample per line: {"logits": [...], "label": 3}. The result is written as the model's calibration
+// file.
+func main() {
+	in := flag.String("in", "-", "validation samples, - for stdin")
+	out := flag.String("out", "-", "calibration file to write, - for stdout")
+	probabilities := flag.Bool("probabilities", false, "samples hold probabilities rather than logits")
+	bins := flag.Int("bins", 15, "bins for the expected calibration error")
+	flag.Parse()
+
+	samples, err := readSamples(*in, *probabilities)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to read samples")
+	}
+	temperature, err := calibration.Fit(samples)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to fit temperature")
+	}
+	logrus.WithFields(logrus.Fields{
+		"samples":    len(samples),
+		"nll_before": calibration.NLL(samples, 1),
+		"nll_after":  calibration.NLL(samples, temperature),
+		"ece_before": calibration.ECE(samples, 1, *bins),
+		"ece_after":  calibration.ECE(samples, temperature, *bins),
+	}).Infof("fitted temperature %.4f", temperature)
+
+	data, err := json.Marshal(calibration.Params{Temperature: temperature})
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to marshal calibration")
+	}
+	if *out == "-" {
+		fmt.Println(string(data))
+		return
+	}
+	if err := ioutil.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+		logrus.WithError(err).Fatal("unable to write calibration")
+	}
+}
+
+// readSamples reads one sample per line, probabilities are turned into log probabilities which
+// calibrate the same way as the logits they came from
+func readSamples(path string, probabilities bool) ([]calibration.Sample, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var samples []calibration.Sample
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var s calibration.Sample
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if probabilities {
+			for i, p := range s.Logits {
+				s.Logits[i] = float32(math.Log(math.Max(float64(p), 1e-12)))
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"nature-id-api/internal"
 	"nature-id-api/internal/connection"
 	"nature-id-api/internal/handlers/rest"
+	"nature-id-api/internal/jobs"
+	"nature-id-api/internal/jobs/store"
 	"nature-id-api/internal/predictor"
 	"nature-id-api/internal/speciesfinder"
 	"nature-id-api/internal/speciesfinder/cache"
 	"nature-id-api/internal/speciesfinder/client/wiki"
 	"nature-id-api/internal/speciesfinder/client/wolframalpha"
 	"nature-id-api/internal/storage"
+	"nature-id-api/internal/webhook"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 const (
@@ -37,32 +44,97 @@ func main() {
 
 	router.Use(cors, endpointLogging)
 
-	bucket, err := storage.NewGCPBucketStorage(storage.LoadBucketConfig())
+	bucket, err := storage.NewBucketStorage(storage.LoadBucketConfig())
 	if err != nil {
 		logrus.WithError(err).Fatal("unable to create bucket")
 	}
 	defer bucket.Close()
 
+	var redisConn *redis.Client
+	if os.Getenv("REDIS_URL") != "" || os.Getenv("JOB_STORE") == "redis" {
+		redisConn = connection.NewRedisClientDefault()
+		defer redisConn.Close()
+	}
+
 	speciesCache := cache.NewMemoryCache()
 	if os.Getenv("REDIS_URL") != "" {
 		logrus.Info("using redis cache")
-		redisConn := connection.NewRedisClientDefault()
-		defer redisConn.Close()
 		speciesCache = cache.NewRedisCache(redisConn)
 	}
 
 	clients := []speciesfinder.Client{wolframalpha.NewClient(), wiki.NewClient()}
 	speciesService := speciesfinder.NewSpeciesFinderService(speciesCache, clients)
 
-	modelConfig := predictor.LoadModelConfig()
-	pred, err := predictor.NewTensorflowPredictor(bucket, modelConfig.GetModelPath(), modelConfig.GetLabelFilePath())
+	artifacts := storage.NewArtifactStore(bucket, storage.LoadArtifactConfig())
+	registryConfig, err := predictor.LoadRegistryConfig()
+	if err != nil {
+		logrus.WithField("err", err).Fatal("invalid model config")
+	}
+	models, err := predictor.NewModelRegistry(artifacts, registryConfig)
 	if err != nil {
 		logrus.WithField("err", err).Fatal("unable to start service")
 	}
+	defer models.Close()
+	// /v1/predict and jobs use the default model
+	pred, err := models.Model("")
+	if err != nil {
+		logrus.WithField("err", err).Fatal("unable to find default model")
+	}
+	routeConfig := predictor.LoadRouteConfig()
+	if routeConfig.Candidate != "" {
+		candidate, err := models.Model(routeConfig.Candidate)
+		if err != nil {
+			logrus.WithField("err", err).Fatal("unable to find candidate model")
+		}
+		primary, _ := models.Info("")
+		pred, err = predictor.NewRoutedPredictor(pred, candidate, primary.Name, routeConfig.Candidate, routeConfig)
+		if err != nil {
+			logrus.WithField("err", err).Fatal("unable to route to candidate model")
+		}
+		defer pred.Close()
+		logrus.WithFields(logrus.Fields{"candidate": routeConfig.Candidate, "mode": routeConfig.Mode}).Info("routing to candidate model")
+	}
 
+	jobConfig := jobs.LoadJobConfig()
+	jobStore := store.NewMemoryStore(jobConfig.Retention)
+	if os.Getenv("JOB_STORE") == "redis" {
+		logrus.Info("using redis job store")
+		jobStore = store.NewRedisStore(redisConn, jobConfig.Retention, jobConfig.Instance)
+	}
+	// callbacks are only offered when they can be signed, jobs still run without them
+	var notifier jobs.Notifier
+	var deadLetters webhook.DeadLetterStore
+	if webhookConfig := webhook.LoadWebhookConfig(); webhookConfig.Secret != "" {
+		deadLetters = webhook.NewMemoryDeadLetters(100)
+		webhookNotifier, err := webhook.NewNotifier(webhookConfig, deadLetters)
+		if err != nil {
+			logrus.WithField("err", err).Fatal("unable to create webhook notifier")
+		}
+		// deferred before the job service so jobs finish, and notify, before deliveries are drained
+		defer webhookNotifier.Close()
+		notifier = webhookNotifier
+	} else {
+		logrus.Info("WEBHOOK_SECRET not set, job callbacks disabled")
+	}
+	jobService := jobs.NewJobService(pred, jobStore, notifier, jobConfig)
+	defer jobService.Close()
+
+	// jobs routes are more specific than predict so they're registered first
+	rest.MakeV1JobHandler(router, jobService)
+	rest.MakeV1InferenceStatsHandler(router, pred, models)
+	if routed, ok := pred.(internal.RoutingMonitor); ok {
+		rest.MakeV1RoutingHandler(router, routed)
+	}
 	rest.MakeV1PredictHandler(router, pred)
+	rest.MakeV1ModelsHandler(router, models)
 	rest.MakeV1SpeciesHandler(router, speciesService)
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		rest.MakeV1AdminHandler(router, models, deadLetters, token)
+	} else {
+		logrus.Info("ADMIN_TOKEN not set, admin routes disabled")
+	}
 
+	server := &http.Server{Addr: port, Handler: (cors)(router)}
 	errs := make(chan error, 2) // This is used to handle and log the reason why the application quit.
 	go func() {
 		logrus.WithFields(
@@ -70,15 +142,22 @@ func main() {
 				"transport": "http",
 				"port":      port,
 			}).Info("server started")
-		errs <- http.ListenAndServe(port, (cors)(router))
+		errs <- server.ListenAndServe()
 	}()
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	logrus.WithField("error", <-errs).Error("terminated")
+
+	// stop taking requests before the deferred closes shut down the jobs and models they use
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Warn("unable to shut down server cleanly")
+	}
 }
 
 func endpointLogging(h http.Handler) http.Handler {
@@ -1,16 +1,23 @@
 module nature-id-api
 
 require (
+	cloud.google.com/go v0.44.3
+	github.com/aws/aws-sdk-go v1.19.45
 	github.com/go-redis/redis/v8 v8.0.0-beta.2
 	github.com/golang/protobuf v1.4.2 // indirect
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/sirupsen/logrus v1.4.2
 	github.com/tensorflow/tensorflow v1.11.0
 	gocloud.dev v0.19.0
 	golang.org/x/crypto v0.0.0-20191227163750-53104e6ec876 // indirect
+	golang.org/x/image v0.0.0-20200430140353-33d19683fad8
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
 	golang.org/x/sys v0.0.0-20200102141924-c96a22e43c9c // indirect
+	google.golang.org/api v0.9.0
+	google.golang.org/protobuf v1.23.0
 )
 
 go 1.13
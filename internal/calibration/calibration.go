@@ -0,0 +1,128 @@
+package calibration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Params are the calibration parameters stored next to a model
+//
+//	{"temperature": 1.6}
+type Params struct {
+	Temperature float32 `json:"temperature"`
+}
+
+// Parse reads calibration parameters, the temperature must be positive
+func Parse(data []byte) (Params, error) {
+	var p Params
+	if err := json.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	if p.Temperature <= 0 {
+		return p, fmt.Errorf("temperature must be positive, got %v", p.Temperature)
+	}
+	return p, nil
+}
+
+// Sample is one labeled validation image, Logits are the model's raw class scores and Label the
+// index of the correct class
+type Sample struct {
+	Logits []float32 `json:"logits"`
+	Label  int       `json:"label"`
+}
+
+// Probabilities returns the softmax of logits divided by the temperature
+func Probabilities(logits []float32, temperature float32) []float64 {
+	max := math.Inf(-1)
+	for _, l := range logits {
+		max = math.Max(max, float64(l/temperature))
+	}
+	probabilities := make([]float64, len(logits))
+	var sum float64
+	for i, l := range logits {
+		probabilities[i] = math.Exp(float64(l/temperature) - max)
+		sum += probabilities[i]
+	}
+	for i := range probabilities {
+		probabilities[i] /= sum
+	}
+	return probabilities
+}
+
+// NLL is the mean negative log likelihood of the correct labels at a temperature
+func NLL(samples []Sample, temperature float32) float64 {
+	var total float64
+	for _, s := range samples {
+		p := Probabilities(s.Logits, temperature)[s.Label]
+		total -= math.Log(math.Max(p, 1e-12))
+	}
+	return total / float64(len(samples))
+}
+
+// ECE is the expected calibration error, the gap between confidence and accuracy averaged over
+// bins of the top probability
+func ECE(samples []Sample, temperature float32, bins int) float64 {
+	confidence := make([]float64, bins)
+	correct := make([]float64, bins)
+	counts := make([]float64, bins)
+	for _, s := range samples {
+		probabilities := Probabilities(s.Logits, temperature)
+		top := 0
+		for i, p := range probabilities {
+			if p > probabilities[top] {
+				top = i
+			}
+		}
+		bin := int(probabilities[top] * float64(bins))
+		if bin == bins {
+			bin--
+		}
+		confidence[bin] += probabilities[top]
+		if top == s.Label {
+			correct[bin]++
+		}
+		counts[bin]++
+	}
+	var ece float64
+	for b := range counts {
+		if counts[b] > 0 {
+			ece += math.Abs(confidence[b]-correct[b]) / float64(len(samples))
+		}
+	}
+	return ece
+}
+
+// Fit finds the temperature minimizing the negative log likelihood of the samples with a golden
+// section search over log temperature between 0.05 and 20, the likelihood is convex in it
+func Fit(samples []Sample) (float32, error) {
+	if len(samples) == 0 {
+		return 0, errors.New("no samples to fit")
+	}
+	for i, s := range samples {
+		if s.Label < 0 || s.Label >= len(s.Logits) {
+			return 0, fmt.Errorf("sample %d has label %d outside its %d logits", i, s.Label, len(s.Logits))
+		}
+	}
+
+	nll := func(logT float64) float64 {
+		return NLL(samples, float32(math.Exp(logT)))
+	}
+	ratio := (math.Sqrt(5) - 1) / 2
+	lo, hi := math.Log(0.05), math.Log(20)
+	a, b := hi-ratio*(hi-lo), lo+ratio*(hi-lo)
+	fa, fb := nll(a), nll(b)
+	for hi-lo > 1e-4 {
+		if fa < fb {
+			hi, b, fb = b, a, fa
+			a = hi - ratio*(hi-lo)
+			fa = nll(a)
+		} else {
+			lo, a, fa = a, b, fb
+			b = lo + ratio*(hi-lo)
+			fb = nll(b)
+		}
+	}
+	return float32(math.Exp((lo + hi) / 2)), nil
+}
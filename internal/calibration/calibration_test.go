@@ -0,0 +1,131 @@
+package calibration
+
+import (
+	"math"
+	"testing"
+)
+
+var ln3 = float32(math.Log(3))
+
+// split returns three correct and one wrong sample with the same two logits, the best temperature
+// makes the top probability 0.75 so for logits {z, 0} it is z / ln 3
+func split(z float32) []Sample {
+	logits := []float32{z, 0}
+	return []Sample{{logits, 0}, {logits, 0}, {logits, 0}, {logits, 1}}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    float32
+		wantErr bool
+	}{
+		{`{"temperature": 1.6}`, 1.6, false},
+		{`{"temperature": 0}`, 0, true},
+		{`{"temperature": -1}`, 0, true},
+		{`{}`, 0, true},
+		{`temperature`, 0, true},
+	}
+	for _, tt := range tests {
+		p, err := Parse([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%s) returned %v, want error %v", tt.data, err, tt.wantErr)
+			continue
+		}
+		if err == nil && p.Temperature != tt.want {
+			t.Errorf("Parse(%s) = %v, want %v", tt.data, p.Temperature, tt.want)
+		}
+	}
+}
+
+func TestNLL(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     []Sample
+		temperature float32
+		want        float64
+	}{
+		{"uniform", []Sample{{[]float32{0, 0}, 0}}, 1, math.Log(2)},
+		{"correct", []Sample{{[]float32{ln3, 0}, 0}}, 1, -math.Log(0.75)},
+		{"wrong", []Sample{{[]float32{ln3, 0}, 1}}, 1, -math.Log(0.25)},
+		{"scaled", []Sample{{[]float32{2 * ln3, 0}, 0}}, 2, -math.Log(0.75)},
+		{"mean", split(ln3), 1, -(3*math.Log(0.75) + math.Log(0.25)) / 4},
+	}
+	for _, tt := range tests {
+		if got := NLL(tt.samples, tt.temperature); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("%s: NLL = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestECE(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     []Sample
+		temperature float32
+		want        float64
+	}{
+		{"calibrated", split(ln3), 1, 0},
+		{"overconfident", split(2 * ln3), 1, 0.15},
+		{"tempered", split(2 * ln3), 2, 0},
+		{"coin flip", []Sample{{[]float32{0, 0}, 0}}, 1, 0.5},
+		{"half right", []Sample{{[]float32{ln3, 0}, 0}, {[]float32{ln3, 0}, 1}}, 1, 0.25},
+	}
+	for _, tt := range tests {
+		if got := ECE(tt.samples, tt.temperature, 10); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("%s: ECE = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []Sample
+		want    float32
+	}{
+		{"calibrated", split(ln3), 1},
+		{"overconfident", split(2 * ln3), 2},
+		{"underconfident", split(ln3 / 2), 0.5},
+		{"three classes", []Sample{
+			{[]float32{3 * ln3, 0, 0}, 0},
+			{[]float32{0, 3 * ln3, 0}, 1},
+			{[]float32{0, 0, 3 * ln3}, 2},
+			{[]float32{3 * ln3, 0, 0}, 1},
+			{[]float32{0, 3 * ln3, 0}, 2},
+		}, 0},
+	}
+	for _, tt := range tests {
+		got, err := Fit(tt.samples)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.want == 0 {
+			// no closed form, the fit only has to beat the temperatures either side of it
+			if NLL(tt.samples, got) > NLL(tt.samples, got*1.01) || NLL(tt.samples, got) > NLL(tt.samples, got/1.01) {
+				t.Errorf("%s: temperature %v is not a minimum", tt.name, got)
+			}
+			continue
+		}
+		if math.Abs(float64(got-tt.want)) > 1e-3 {
+			t.Errorf("%s: Fit = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFitErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []Sample
+	}{
+		{"empty", nil},
+		{"negative label", []Sample{{[]float32{1, 0}, -1}}},
+		{"label past logits", []Sample{{[]float32{1, 0}, 2}}},
+	}
+	for _, tt := range tests {
+		if _, err := Fit(tt.samples); err == nil {
+			t.Errorf("%s: Fit returned no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package rest
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"nature-id-api/internal"
+	"nature-id-api/internal/webhook"
+	"net/http"
+	"strings"
+)
+
+const adminBaseURL = "/v1/admin"
+
+type adminHandler struct {
+	registry    internal.ModelRegistry
+	deadLetters webhook.DeadLetterStore
+	token       string
+}
+
+// MakeV1AdminHandler serves admin only routes, every request must send the token as a bearer token.
+// Dead letters hold client callback urls and predictions so they're only listed here, deadLetters
+// is nil when callbacks are disabled
+func MakeV1AdminHandler(mr *mux.Router, registry internal.ModelRegistry, deadLetters webhook.DeadLetterStore, token string) http.Handler {
+
+	r := mr.PathPrefix(adminBaseURL).Subrouter()
+
+	h := &adminHandler{
+		registry:    registry,
+		deadLetters: deadLetters,
+		token:       token,
+	}
+
+	r.Use(h.authorize)
+	r.HandleFunc("/reload", h.Reload).Methods("POST")
+	if deadLetters != nil {
+		r.HandleFunc("/dead-letters", h.DeadLetters).Methods("GET")
+	}
+
+	return r
+}
+
+func (h *adminHandler) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			makeError(w, http.StatusUnauthorized, "invalid admin token", "authorize")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reload swaps in a new version of the model named by the model query parameter, or the default model
+func (h *adminHandler) Reload(w http.ResponseWriter, r *http.Request) {
+
+	name := r.URL.Query().Get("model")
+	logrus.WithField("model", name).Info("reloading model")
+	if err := h.registry.Reload(name); err != nil {
+		if errors.Is(err, internal.ErrModelNotFound) {
+			makeModelError(w, err, "reload")
+			return
+		}
+		logrus.WithError(err).Error("reload failed, previous model still serving")
+		makeError(w, http.StatusInternalServerError, "Unable to reload model: "+err.Error(), "reload")
+		return
+	}
+	info, err := h.registry.Info(name)
+	if err != nil {
+		makeModelError(w, err, "reload")
+		return
+	}
+	encodeResponse(r.Context(), w, info)
+}
+
+// DeadLetters lists the callbacks that couldn't be delivered
+func (h *adminHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	encodeResponse(r.Context(), w, h.deadLetters.List())
+}
@@ -0,0 +1,49 @@
+package rest
+
+import (
+	"github.com/gorilla/mux"
+	"nature-id-api/internal/webhook"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminDeadLetters(t *testing.T) {
+	deadLetters := webhook.NewMemoryDeadLetters(1)
+	deadLetters.Put(webhook.DeadLetter{JobID: "job-1", URL: "https://example.com/hook"})
+
+	tests := []struct {
+		name        string
+		deadLetters webhook.DeadLetterStore
+		token       string
+		want        int
+	}{
+		{"authorized", deadLetters, "secret", http.StatusOK},
+		{"wrong token", deadLetters, "guess", http.StatusUnauthorized},
+		{"no token", deadLetters, "", http.StatusUnauthorized},
+		{"callbacks disabled", nil, "secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		router := mux.NewRouter()
+		MakeV1AdminHandler(router, fakeRegistry{}, tt.deadLetters, "secret")
+
+		req := httptest.NewRequest(http.MethodGet, adminBaseURL+"/dead-letters", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// the old unauthenticated route is gone
+	router := mux.NewRouter()
+	MakeV1AdminHandler(router, fakeRegistry{}, deadLetters, "secret")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/webhooks/dead-letters", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for /v1/webhooks/dead-letters, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,177 @@
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"mime"
+	"nature-id-api/internal"
+	"net/http"
+	"path"
+)
+
+const (
+	maxBatchBytes  = 256 << 20 // whole request, and every image in it once archives are decompressed
+	maxImageBytes  = 32 << 20  // single image, including uncompressed archive entries
+	maxBatchImages = 100
+)
+
+var (
+	errImageTooLarge = errors.New("image is too large")
+	// errBatchTooLarge is returned once a batch's decompressed images add up to more than maxBatchBytes
+	errBatchTooLarge = fmt.Errorf("images may add up to at most %d MB", maxBatchBytes>>20)
+)
+
+// PredictBatch accepts many images as repeated file parts, zip archives in file parts or a zip
+// request body, and responds with results keyed by file name
+func (h *predictHandler) PredictBatch(w http.ResponseWriter, r *http.Request) {
+
+	logrus.Info("received batch prediction request")
+	opts, err := parsePredictOptions(r.URL.Query())
+	if err != nil {
+		makeError(w, http.StatusBadRequest, err.Error(), "batch")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	imgs, err := readBatch(r)
+	if err != nil {
+		makeError(w, http.StatusBadRequest, "Unable to read images: "+err.Error(), "batch")
+		return
+	}
+	if len(imgs) == 0 {
+		makeError(w, http.StatusBadRequest, "No images in request", "batch")
+		return
+	}
+	if hasCallback(r) {
+		makeError(w, http.StatusBadRequest, errCallbackNotSupported.Error(), "batch")
+		return
+	}
+
+	logrus.WithField("images", len(imgs)).Info("starting batch prediction")
+	results, err := h.service.PredictBatch(imgs, opts)
+	if err != nil {
+		makePredictError(w, err, "batch")
+		return
+	}
+	logrus.Info("batch prediction complete")
+
+	w.WriteHeader(http.StatusCreated)
+	encodeResponse(r.Context(), w, results)
+}
+
+// batch collects uniquely named images up to maxBatchImages and budget bytes in total
+type batch struct {
+	imgs   []internal.Image
+	seen   map[string]int
+	budget int
+}
+
+func (b *batch) add(name string, data []byte) error {
+	if len(b.imgs) == maxBatchImages {
+		return fmt.Errorf("at most %d images are allowed", maxBatchImages)
+	}
+	if len(data) > b.budget {
+		return errBatchTooLarge
+	}
+	b.budget -= len(data)
+	if b.seen[name] > 0 {
+		// keep every image even when names collide
+		b.seen[name]++
+		name = fmt.Sprintf("%s (%d)", name, b.seen[name])
+	}
+	b.seen[name]++
+	b.imgs = append(b.imgs, internal.Image{Name: name, Body: bytes.NewReader(data)})
+	return nil
+}
+
+func readBatch(r *http.Request) ([]internal.Image, error) {
+	b := &batch{seen: make(map[string]int), budget: maxBatchBytes}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/zip" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.addArchive(data); err != nil {
+			return nil, err
+		}
+		return b.imgs, nil
+	}
+
+	if err := r.ParseMultipartForm(maxImageBytes); err != nil {
+		return nil, err
+	}
+	for _, fh := range r.MultipartForm.File["file"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := readImage(f, maxImageBytes)
+		if err != nil {
+			return nil, err
+		}
+		if http.DetectContentType(data) == "application/zip" {
+			if err := b.addArchive(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := b.add(fh.Filename, data); err != nil {
+			return nil, err
+		}
+	}
+	return b.imgs, nil
+}
+
+// addArchive adds every image in a zip, keyed by file name without its directory. Entries are only
+// decompressed up to what's left of the batch's budget so a small archive can't expand without bound
+func (b *batch) addArchive(data []byte) error {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		// skip directories and hidden files such as __MACOSX resource forks
+		if f.FileInfo().IsDir() || name[0] == '.' {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := readImage(rc, b.budget)
+		if err == errImageTooLarge && b.budget < maxImageBytes {
+			return errBatchTooLarge
+		}
+		if err != nil {
+			return err
+		}
+		if err := b.add(name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImage reads and closes a single image, refusing anything larger than limit or maxImageBytes
+func readImage(f io.ReadCloser, limit int) ([]byte, error) {
+	defer f.Close()
+	if limit > maxImageBytes {
+		limit = maxImageBytes
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, errImageTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func zipArchive(t *testing.T, files map[string][]byte, order ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range order {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(files[name])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAddArchiveNames(t *testing.T) {
+	files := map[string][]byte{
+		"a/x.jpg":            []byte("a"),
+		"b/x.jpg":            []byte("b"),
+		"__MACOSX/a/._x.jpg": []byte("fork"),
+		"b/.hidden":          []byte("hidden"),
+		"y.jpg":              []byte("y"),
+	}
+	archive := zipArchive(t, files, "a/x.jpg", "__MACOSX/a/._x.jpg", "b/x.jpg", "b/.hidden", "y.jpg")
+
+	b := &batch{seen: make(map[string]int), budget: maxBatchBytes}
+	if err := b.addArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, img := range b.imgs {
+		names = append(names, img.Name)
+	}
+	want := []string{"x.jpg", "x.jpg (2)", "y.jpg"}
+	if len(names) != len(want) {
+		t.Fatalf("got images %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got images %v, want %v", names, want)
+		}
+	}
+}
+
+func TestAddArchiveBudget(t *testing.T) {
+	// zeros compress to almost nothing, the archive is far smaller than what it expands to
+	zeros := make([]byte, 1<<20)
+	files := map[string][]byte{"1.jpg": zeros, "2.jpg": zeros, "3.jpg": zeros}
+	archive := zipArchive(t, files, "1.jpg", "2.jpg", "3.jpg")
+	if len(archive) > 1<<16 {
+		t.Fatalf("archive is %d bytes, expected it to compress", len(archive))
+	}
+
+	tests := []struct {
+		name    string
+		budget  int
+		want    error
+		wantLen int
+	}{
+		{"fits", 3 << 20, nil, 3},
+		{"one byte short", 3<<20 - 1, errBatchTooLarge, 2},
+		{"second archive entry over", 1<<20 + 1, errBatchTooLarge, 1},
+	}
+	for _, tt := range tests {
+		b := &batch{seen: make(map[string]int), budget: tt.budget}
+		if err := b.addArchive(archive); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		if len(b.imgs) != tt.wantLen {
+			t.Errorf("%s: added %d images, want %d", tt.name, len(b.imgs), tt.wantLen)
+		}
+	}
+
+	// the budget is shared by every archive in the batch
+	b := &batch{seen: make(map[string]int), budget: 4 << 20}
+	if err := b.addArchive(archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.addArchive(archive); err != errBatchTooLarge {
+		t.Errorf("second archive got %v, want %v", err, errBatchTooLarge)
+	}
+}
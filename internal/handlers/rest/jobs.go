@@ -0,0 +1,95 @@
+package rest
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"nature-id-api/internal"
+	"net/http"
+	"net/url"
+)
+
+const jobsBaseURL = "/v1/predict/jobs"
+
+type jobHandler struct {
+	service internal.JobRunner
+}
+
+func MakeV1JobHandler(mr *mux.Router, service internal.JobRunner) http.Handler {
+
+	r := mr.PathPrefix(jobsBaseURL).Subrouter()
+
+	h := &jobHandler{
+		service: service,
+	}
+
+	r.HandleFunc("", h.Create).Methods("POST")
+	r.HandleFunc("/", h.Create).Methods("POST")
+	r.HandleFunc("/{id}", h.Find).Methods("GET")
+
+	return r
+}
+
+func (h *jobHandler) Create(w http.ResponseWriter, r *http.Request) {
+
+	opts, err := parsePredictOptions(r.URL.Query())
+	if err != nil {
+		makeError(w, http.StatusBadRequest, err.Error(), "create")
+		return
+	}
+	callbackURL := r.FormValue("callback_url")
+	if callbackURL != "" {
+		u, err := url.Parse(callbackURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			makeError(w, http.StatusBadRequest, "callback_url must be an absolute http or https url", "create")
+			return
+		}
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		makeError(w, http.StatusBadRequest, "Unable to parse form: "+err.Error(), "create")
+		return
+	}
+	defer file.Close()
+	img, err := ioutil.ReadAll(file)
+	if err != nil {
+		makeError(w, http.StatusBadRequest, "Unable to read file: "+err.Error(), "create")
+		return
+	}
+
+	job, err := h.service.Submit(img, opts, callbackURL)
+	if errors.Is(err, internal.ErrCallbacksDisabled) {
+		makeError(w, http.StatusBadRequest, err.Error(), "create")
+		return
+	}
+	if errors.Is(err, internal.ErrQueueFull) || errors.Is(err, internal.ErrJobsClosed) {
+		makeError(w, http.StatusServiceUnavailable, err.Error(), "create")
+		return
+	}
+	if err != nil {
+		makeError(w, http.StatusInternalServerError, err.Error(), "create")
+		return
+	}
+	logrus.WithField("id", job.ID).Info("job created")
+
+	w.Header().Set("Location", jobsBaseURL+"/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	encodeResponse(r.Context(), w, job)
+}
+
+func (h *jobHandler) Find(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	job, err := h.service.Get(vars["id"])
+	if errors.Is(err, internal.ErrJobNotFound) {
+		makeError(w, http.StatusNotFound, err.Error(), "get")
+		return
+	}
+	if err != nil {
+		makeError(w, http.StatusInternalServerError, err.Error(), "get")
+		return
+	}
+
+	encodeResponse(r.Context(), w, job)
+}
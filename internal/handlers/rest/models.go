@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"nature-id-api/internal"
+	"net/http"
+)
+
+const modelsBaseURL = "/v1/models"
+
+type modelsHandler struct {
+	registry internal.ModelRegistry
+}
+
+func MakeV1ModelsHandler(mr *mux.Router, registry internal.ModelRegistry) http.Handler {
+
+	r := mr.PathPrefix(modelsBaseURL).Subrouter()
+
+	h := &modelsHandler{
+		registry: registry,
+	}
+
+	r.HandleFunc("", h.List).Methods("GET")
+	r.HandleFunc("/", h.List).Methods("GET")
+	r.HandleFunc("/{name}", h.Info).Methods("GET")
+	r.HandleFunc("/{name}/predict", h.Predict).Methods("POST")
+	r.HandleFunc("/{name}/predict/batch", h.PredictBatch).Methods("POST")
+
+	return r
+}
+
+func (h *modelsHandler) List(w http.ResponseWriter, r *http.Request) {
+	encodeResponse(r.Context(), w, h.registry.List())
+}
+
+func (h *modelsHandler) Info(w http.ResponseWriter, r *http.Request) {
+	info, err := h.registry.Info(mux.Vars(r)["name"])
+	if err != nil {
+		makeModelError(w, err, "info")
+		return
+	}
+	encodeResponse(r.Context(), w, info)
+}
+
+// Predict runs the same prediction as /v1/predict/ on the named model
+func (h *modelsHandler) Predict(w http.ResponseWriter, r *http.Request) {
+	service, err := h.registry.Model(mux.Vars(r)["name"])
+	if err != nil {
+		makeModelError(w, err, "predict")
+		return
+	}
+	(&predictHandler{service: service}).Predict(w, r)
+}
+
+func (h *modelsHandler) PredictBatch(w http.ResponseWriter, r *http.Request) {
+	service, err := h.registry.Model(mux.Vars(r)["name"])
+	if err != nil {
+		makeModelError(w, err, "batch")
+		return
+	}
+	(&predictHandler{service: service}).PredictBatch(w, r)
+}
+
+func makeModelError(w http.ResponseWriter, err error, method string) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, internal.ErrModelNotFound) {
+		code = http.StatusNotFound
+	}
+	makeError(w, code, err.Error(), method)
+}
@@ -3,12 +3,16 @@ package rest
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"math"
 	"nature-id-api/internal"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // BaseURL for http endpoint
@@ -27,14 +31,19 @@ func MakeV1PredictHandler(mr *mux.Router, service internal.Predictor) http.Handl
 	}
 
 	r.HandleFunc("/", h.Predict).Methods("POST")
+	r.HandleFunc("/batch", h.PredictBatch).Methods("POST")
 
 	return r
 }
 
 func (h *predictHandler) Predict(w http.ResponseWriter, r *http.Request) {
 
-	//TODO check extension (jpg)
 	logrus.Info("received prediction request")
+	opts, err := parsePredictOptions(r.URL.Query())
+	if err != nil {
+		makeError(w, http.StatusBadRequest, err.Error(), "create")
+		return
+	}
 	file, _, err := r.FormFile("file")
 	if err != nil {
 		makeError(w, http.StatusBadRequest, "Unable to parse form: "+err.Error(), "create")
@@ -44,17 +53,212 @@ func (h *predictHandler) Predict(w http.ResponseWriter, r *http.Request) {
 		makeError(w, http.StatusBadRequest, "File missing from form", "create")
 		return
 	}
+	if hasCallback(r) {
+		makeError(w, http.StatusBadRequest, errCallbackNotSupported.Error(), "create")
+		return
+	}
 	logrus.Info("starting prediction")
-	labels, err := h.service.Predict(file)
+	result, err := h.service.Predict(file, opts)
 	if err != nil {
-		makeError(w, http.StatusInternalServerError, err.Error(), "predict")
+		makePredictError(w, err, "predict")
 		return
 	}
 	logrus.Info("prediction complete")
 
-	sort.Sort(labels)
+	if result.Unknown != nil {
+		w.Header().Set(internal.UnknownHeader, "true")
+	}
 	w.WriteHeader(http.StatusCreated)
-	encodeResponse(r.Context(), w, labels)
+	// a bare list unless the request asked for more than predictions or the photo was rejected, an
+	// empty list alone would read as nothing found
+	if opts.Rollup == "" && result.Unknown == nil {
+		encodeResponse(r.Context(), w, result.Predictions)
+		return
+	}
+	encodeResponse(r.Context(), w, result)
+}
+
+// errCallbackNotSupported is returned when a synchronous prediction is sent a callback_url, the
+// predictions are in the response so only jobs call back
+var errCallbackNotSupported = errors.New("callback_url is only accepted by " + jobsBaseURL + ", this endpoint responds with the predictions")
+
+// hasCallback reports whether the request set a callback_url in the query or an already parsed form
+func hasCallback(r *http.Request) bool {
+	if r.URL.Query().Get("callback_url") != "" {
+		return true
+	}
+	return r.MultipartForm != nil && len(r.MultipartForm.Value["callback_url"]) > 0
+}
+
+// parsePredictOptions reads min_probability, limit, include, exclude, rollup, rollup_threshold,
+// lat, lng, geo, date and season from the query, label id lists can be comma separated or repeated
+func parsePredictOptions(query url.Values) (opts internal.PredictOptions, err error) {
+	if v := query.Get("min_probability"); v != "" {
+		p, err := strconv.ParseFloat(v, 32)
+		if err != nil || p < 0 || p > 100 {
+			return opts, errors.New("min_probability must be a percentage between 0 and 100")
+		}
+		min := float32(p)
+		opts.MinProbability = &min
+	}
+	if v := query.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 {
+			return opts, errors.New("limit must be a positive number")
+		}
+		opts.Limit = &l
+	}
+	if opts.Include, err = parseIDs(query["include"]); err != nil {
+		return opts, errors.New("include must be a list of label ids")
+	}
+	if opts.Exclude, err = parseIDs(query["exclude"]); err != nil {
+		return opts, errors.New("exclude must be a list of label ids")
+	}
+	if v := query.Get("rollup"); v != "" {
+		// rolling up to species would be the predictions themselves
+		if i := internal.RankIndex(v); i < 0 || i == len(internal.Ranks)-1 {
+			return opts, errors.New("rollup must be one of kingdom, phylum, class, order, family or genus")
+		}
+		opts.Rollup = v
+	}
+	if lat, lng := query.Get("lat"), query.Get("lng"); lat != "" || lng != "" {
+		la, latErr := strconv.ParseFloat(lat, 64)
+		ln, lngErr := strconv.ParseFloat(lng, 64)
+		if latErr != nil || lngErr != nil || la < -90 || la > 90 || ln < -180 || ln > 180 {
+			return opts, errors.New("lat and lng must both be set, lat between -90 and 90 and lng between -180 and 180")
+		}
+		opts.Location = &internal.Location{Lat: la, Lng: ln}
+	}
+	if v := query.Get("geo"); v != "" {
+		geo, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.New("geo must be true or false")
+		}
+		opts.NoGeo = !geo
+	}
+	if v := query.Get("date"); v != "" {
+		date, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return opts, errors.New("date must be formatted as YYYY-MM-DD")
+		}
+		opts.Date = &date
+	}
+	if v := query.Get("season"); v != "" {
+		season, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.New("season must be true or false")
+		}
+		opts.NoSeason = !season
+	}
+	if v := query.Get("rollup_threshold"); v != "" {
+		t, err := strconv.ParseFloat(v, 32)
+		if err != nil || t <= 0 || t > 100 {
+			return opts, errors.New("rollup_threshold must be a percentage between 0 and 100")
+		}
+		opts.RollupThreshold = float32(t)
+	}
+	return opts, nil
+}
+
+func parseIDs(values []string) ([]int, error) {
+	var ids []int
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part == "" {
+				continue
+			}
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// makePredictError writes a predictor error, telling busy clients when to retry
+func makePredictError(w http.ResponseWriter, err error, method string) {
+	var busy *internal.BusyError
+	if errors.As(err, &busy) {
+		seconds := int(math.Ceil(busy.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	makeError(w, predictErrorCode(err), err.Error(), method)
+}
+
+// predictErrorCode maps predictor errors to http status codes
+func predictErrorCode(err error) int {
+	switch {
+	case errors.Is(err, internal.ErrInvalidImage):
+		return http.StatusBadRequest
+	case errors.Is(err, internal.ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, internal.ErrModelUnavailable), errors.Is(err, internal.ErrBusy):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type statsHandler struct {
+	service  internal.MonitoredPredictor
+	registry internal.ModelRegistry
+}
+
+// MakeV1InferenceStatsHandler reports the state and stats of the predictor behind /v1/predict along
+// with those of every registered model
+func MakeV1InferenceStatsHandler(mr *mux.Router, service internal.MonitoredPredictor, registry internal.ModelRegistry) http.Handler {
+
+	r := mr.PathPrefix(predictBaseURL).Subrouter()
+
+	h := &statsHandler{
+		service:  service,
+		registry: registry,
+	}
+
+	r.HandleFunc("/stats", h.Stats).Methods("GET")
+	r.HandleFunc("/status", h.Status).Methods("GET")
+
+	return r
+}
+
+// predictStats are the /v1/predict stats at the top level, as before models were named, and each
+// model's own keyed by name
+type predictStats struct {
+	internal.InferenceStats
+	Models map[string]internal.InferenceStats `json:"models"`
+}
+
+type predictStatus struct {
+	State  internal.ModelState            `json:"state"`
+	Models map[string]internal.ModelState `json:"models"`
+}
+
+func (h *statsHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	stats := predictStats{
+		InferenceStats: h.service.Stats(),
+		Models:         make(map[string]internal.InferenceStats),
+	}
+	for _, info := range h.registry.List() {
+		stats.Models[info.Name] = info.Stats
+	}
+	encodeResponse(r.Context(), w, stats)
+}
+
+// Status is unavailable until the model behind /v1/predict is ready, other models don't affect it
+func (h *statsHandler) Status(w http.ResponseWriter, r *http.Request) {
+	status := predictStatus{
+		State:  h.service.State(),
+		Models: make(map[string]internal.ModelState),
+	}
+	for _, info := range h.registry.List() {
+		status.Models[info.Name] = info.State
+	}
+	if status.State != internal.ModelReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encodeResponse(r.Context(), w, status)
 }
 
 func makeError(w http.ResponseWriter, code int, message string, method string) {
@@ -0,0 +1,191 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"nature-id-api/internal"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// fakePredictor decodes the upload like the real predictor and finds a robin in anything valid
+type fakePredictor struct{}
+
+func (fakePredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	if _, _, err := image.Decode(img); err != nil {
+		return internal.Result{}, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+	}
+	return internal.Result{Predictions: internal.Predictions{{ID: 1, Name: "robin", Probability: 90}}}, nil
+}
+
+func (fakePredictor) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+	return nil, nil
+}
+
+func (fakePredictor) State() internal.ModelState {
+	return internal.ModelReady
+}
+
+func (fakePredictor) Close() error {
+	return nil
+}
+
+func postImage(t *testing.T, url string, data []byte) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "upload.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+	resp, err := http.Post(url, form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// TestPredictInvalidImage checks garbage uploads are a bad request and the server keeps serving
+func TestPredictInvalidImage(t *testing.T) {
+	router := mux.NewRouter()
+	MakeV1PredictHandler(router, fakePredictor{})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp := postImage(t, server.URL+"/v1/predict/", []byte("definitely not an image"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d for garbage, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	var valid bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	if err := png.Encode(&valid, img); err != nil {
+		t.Fatal(err)
+	}
+	resp = postImage(t, server.URL+"/v1/predict/", valid.Bytes())
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d after a garbage upload, want %d", resp.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestPredictErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w: bad header", internal.ErrInvalidImage), http.StatusBadRequest},
+		{fmt.Errorf("%w: text/plain", internal.ErrUnsupportedFormat), http.StatusUnsupportedMediaType},
+		{internal.ErrModelUnavailable, http.StatusServiceUnavailable},
+		{&internal.BusyError{}, http.StatusServiceUnavailable},
+		{internal.ErrInference, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := predictErrorCode(tt.err); got != tt.want {
+			t.Errorf("predictErrorCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestParsePredictOptionsExplicitZero checks an explicit 0 is kept apart from an unset option
+func TestParsePredictOptionsExplicitZero(t *testing.T) {
+	opts, err := parsePredictOptions(url.Values{"min_probability": {"0"}, "limit": {"0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MinProbability == nil || *opts.MinProbability != 0 {
+		t.Errorf("min_probability=0 parsed as %v", opts.MinProbability)
+	}
+	if opts.Limit == nil || *opts.Limit != 0 {
+		t.Errorf("limit=0 parsed as %v", opts.Limit)
+	}
+
+	opts, err = parsePredictOptions(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MinProbability != nil || opts.Limit != nil {
+		t.Errorf("unset options parsed as %v, %v", opts.MinProbability, opts.Limit)
+	}
+}
+
+// TestPredictCallbackRejected checks callback_url is refused rather than ignored on synchronous
+// predictions
+func TestPredictCallbackRejected(t *testing.T) {
+	router := mux.NewRouter()
+	MakeV1PredictHandler(router, fakePredictor{})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("callback_url", "https://example.com/hook")
+	part, err := form.CreateFormFile("file", "upload.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("image"))
+	form.Close()
+	resp, err := http.Post(server.URL+"/v1/predict/", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for a callback_url, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+// rejectingPredictor judges every photo unknown
+type rejectingPredictor struct {
+	fakePredictor
+}
+
+func (rejectingPredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	return internal.Result{
+		Predictions: internal.Predictions{},
+		Unknown:     &internal.Unknown{Rule: "max_probability", Value: 12.5, Threshold: 50},
+	}, nil
+}
+
+// TestPredictUnknownEnvelope checks a rejected photo says so in the body even without a rollup
+func TestPredictUnknownEnvelope(t *testing.T) {
+	router := mux.NewRouter()
+	MakeV1PredictHandler(router, rejectingPredictor{})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "upload.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("image"))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/v1/predict/", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Header().Get(internal.UnknownHeader) != "true" {
+		t.Errorf("missing %s header", internal.UnknownHeader)
+	}
+	var result internal.Result
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("response is not the envelope: %v, %s", err, rec.Body.String())
+	}
+	if result.Unknown == nil || result.Unknown.Rule != "max_probability" || len(result.Predictions) != 0 {
+		t.Errorf("unexpected response %s", rec.Body.String())
+	}
+}
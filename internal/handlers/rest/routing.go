@@ -0,0 +1,28 @@
+package rest
+
+import (
+	"github.com/gorilla/mux"
+	"nature-id-api/internal"
+	"net/http"
+)
+
+type routingHandler struct {
+	monitor internal.RoutingMonitor
+}
+
+func MakeV1RoutingHandler(mr *mux.Router, monitor internal.RoutingMonitor) http.Handler {
+
+	r := mr.PathPrefix(predictBaseURL).Subrouter()
+
+	h := &routingHandler{
+		monitor: monitor,
+	}
+
+	r.HandleFunc("/routing", h.Stats).Methods("GET")
+
+	return r
+}
+
+func (h *routingHandler) Stats(w http.ResponseWriter, r *http.Request) {
+	encodeResponse(r.Context(), w, h.monitor.RoutingStats())
+}
@@ -0,0 +1,118 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"nature-id-api/internal"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeModel is a registered model that only reports its state and stats
+type fakeModel struct {
+	fakePredictor
+	state   internal.ModelState
+	running int
+}
+
+func (m fakeModel) State() internal.ModelState {
+	return m.state
+}
+
+func (m fakeModel) Stats() internal.InferenceStats {
+	return internal.InferenceStats{Workers: 2, Running: m.running}
+}
+
+type fakeRegistry struct {
+	names  []string
+	models map[string]fakeModel
+}
+
+func (r fakeRegistry) Model(name string) (internal.MonitoredPredictor, error) {
+	if name == "" {
+		name = r.names[0]
+	}
+	m, ok := r.models[name]
+	if !ok {
+		return nil, internal.ErrModelNotFound
+	}
+	return m, nil
+}
+
+func (r fakeRegistry) Info(name string) (internal.ModelInfo, error) {
+	m, err := r.Model(name)
+	if err != nil {
+		return internal.ModelInfo{}, err
+	}
+	return internal.ModelInfo{Name: name, State: m.State(), Stats: m.Stats()}, nil
+}
+
+func (r fakeRegistry) List() []internal.ModelInfo {
+	var infos []internal.ModelInfo
+	for _, name := range r.names {
+		info, _ := r.Info(name)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (r fakeRegistry) Reload(name string) error {
+	return nil
+}
+
+func (r fakeRegistry) Close() error {
+	return nil
+}
+
+// TestPredictStatusPerModel checks status and stats cover every registered model, not only the
+// default one
+func TestPredictStatusPerModel(t *testing.T) {
+	registry := fakeRegistry{
+		names: []string{"birds", "plants"},
+		models: map[string]fakeModel{
+			"birds":  {state: internal.ModelReady, running: 1},
+			"plants": {state: internal.ModelLoading},
+		},
+	}
+	router := mux.NewRouter()
+	MakeV1InferenceStatsHandler(router, registry.models["birds"], registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var status predictStatus
+	if code := getJSON(t, server.URL+"/v1/predict/status", &status); code != http.StatusOK {
+		t.Errorf("status responded %d with the default model ready", code)
+	}
+	if status.State != internal.ModelReady || status.Models["birds"] != internal.ModelReady || status.Models["plants"] != internal.ModelLoading {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	var stats predictStats
+	getJSON(t, server.URL+"/v1/predict/stats", &stats)
+	if stats.Running != 1 || len(stats.Models) != 2 || stats.Models["birds"].Running != 1 || stats.Models["plants"].Workers != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// the default model loading is a 503 whatever the others are doing
+	router = mux.NewRouter()
+	MakeV1InferenceStatsHandler(router, registry.models["plants"], registry)
+	loading := httptest.NewServer(router)
+	defer loading.Close()
+	if code := getJSON(t, loading.URL+"/v1/predict/status", &status); code != http.StatusServiceUnavailable {
+		t.Errorf("status responded %d with the default model loading", code)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
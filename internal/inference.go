@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrBusy is returned when every inference worker is in use and the wait queue is full
+var ErrBusy = errors.New("too many predictions in progress")
+
+// BusyError is ErrBusy along with how long the caller should wait before trying again
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string        { return ErrBusy.Error() }
+func (e *BusyError) Is(target error) bool { return target == ErrBusy }
+
+// InferenceStats describes how busy the inference workers are
+type InferenceStats struct {
+	Workers   int   `json:"workers"`
+	Running   int   `json:"running"`
+	Queued    int64 `json:"queued"`
+	QueueSize int   `json:"queue_size"`
+	Completed int64 `json:"completed"`
+	Rejected  int64 `json:"rejected"`
+	// QueuedJobs are background predictions waiting for a worker, they don't count against the queue
+	QueuedJobs int64 `json:"queued_jobs"`
+	// wait times are how long requests spent in the queue before a worker picked them up
+	AverageWaitMS float64 `json:"average_wait_ms"`
+	MaxWaitMS     float64 `json:"max_wait_ms"`
+	AverageRunMS  float64 `json:"average_run_ms"`
+}
+
+type InferenceMonitor interface {
+	Stats() InferenceStats
+}
+
+// MonitoredPredictor is a predictor that reports how busy it is
+type MonitoredPredictor interface {
+	Predictor
+	InferenceMonitor
+}
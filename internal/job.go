@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrJobNotFound is returned for unknown or expired job ids
+	ErrJobNotFound = errors.New("job not found")
+	// ErrQueueFull is returned when no more jobs can be accepted
+	ErrQueueFull = errors.New("job queue is full")
+	// ErrJobsClosed is returned for jobs submitted once the service is shutting down
+	ErrJobsClosed = errors.New("job service is shutting down")
+	// ErrJobInterrupted is the error of jobs left queued or running when the service stopped
+	ErrJobInterrupted = errors.New("job was interrupted by a restart")
+	// ErrCallbacksDisabled is returned for jobs with a callback url when no notifier is configured
+	ErrCallbacksDisabled = errors.New("callback_url is not supported, WEBHOOK_SECRET is not set")
+)
+
+// JobStatus is the progress of an asynchronous prediction
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// Job is an asynchronous prediction and, once done, its result
+type Job struct {
+	ID          string      `json:"id"`
+	Status      JobStatus   `json:"status"`
+	Predictions Predictions `json:"predictions,omitempty"`
+	Rollup      *Rollup     `json:"rollup,omitempty"`
+	Unknown     *Unknown    `json:"unknown,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	// CallbackURL is sent the predictions once the job is done or failed
+	CallbackURL string    `json:"callback_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type JobRunner interface {
+	Submit(img []byte, opts PredictOptions, callbackURL string) (Job, error)
+	Get(id string) (Job, error)
+	Close() error
+}
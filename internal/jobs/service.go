@@ -0,0 +1,205 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"nature-id-api/internal"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func getEnvInt(env string, fallback int) int {
+	e, err := strconv.Atoi(os.Getenv(env))
+	if err != nil {
+		return fallback
+	}
+	return e
+}
+
+type JobConfig struct {
+	Workers   int
+	QueueSize int
+	Retention time.Duration
+	// Instance names this process in a shared store, only its own unfinished jobs are failed when
+	// it restarts
+	Instance string
+}
+
+func LoadJobConfig() JobConfig {
+	hostname, _ := os.Hostname()
+	instance := os.Getenv("JOB_INSTANCE")
+	if instance == "" {
+		instance = hostname
+	}
+	return JobConfig{
+		Workers:   getEnvInt("JOB_WORKERS", 2),
+		QueueSize: getEnvInt("JOB_QUEUE_SIZE", 100),
+		Retention: time.Duration(getEnvInt("JOB_RETENTION_MINUTES", 60)) * time.Minute,
+		Instance:  instance,
+	}
+}
+
+// Store keeps job state, jobs are dropped once they are older than the retention period
+type Store interface {
+	Put(job internal.Job) error
+	Get(id string) (internal.Job, error)
+	// Pending lists the jobs still queued or running
+	Pending() ([]internal.Job, error)
+}
+
+// Notifier is told about every job that finishes
+type Notifier interface {
+	Notify(job internal.Job)
+}
+
+type task struct {
+	job  internal.Job
+	img  []byte
+	opts internal.PredictOptions
+}
+
+type jobService struct {
+	predictor internal.Predictor
+	store     Store
+	notifier  Notifier
+	queue     chan task
+	wg        sync.WaitGroup
+
+	// mu guards closed, the queue is only closed with it held for writing
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewJobService starts the worker pool, notifier may be nil when callbacks aren't supported and jobs
+// with a callback url are then refused. Jobs left unfinished in the store by a previous run are failed, their images aren't kept.
+func NewJobService(predictor internal.Predictor, store Store, notifier Notifier, config JobConfig) internal.JobRunner {
+	s := &jobService{
+		predictor: predictor,
+		store:     store,
+		notifier:  notifier,
+		queue:     make(chan task, config.QueueSize),
+	}
+	s.failPending()
+	for i := 0; i < config.Workers; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	return s
+}
+
+func (s *jobService) Submit(img []byte, opts internal.PredictOptions, callbackURL string) (internal.Job, error) {
+	if callbackURL != "" && s.notifier == nil {
+		return internal.Job{}, internal.ErrCallbacksDisabled
+	}
+	id, err := newID()
+	if err != nil {
+		return internal.Job{}, err
+	}
+	now := time.Now().UTC()
+	job := internal.Job{
+		ID:          id,
+		Status:      internal.JobQueued,
+		CallbackURL: callbackURL,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return internal.Job{}, internal.ErrJobsClosed
+	}
+	if err := s.store.Put(job); err != nil {
+		return internal.Job{}, err
+	}
+
+	select {
+	case s.queue <- task{job: job, img: img, opts: opts}:
+	default:
+		// the caller is told directly so there's nothing to notify
+		job.CallbackURL = ""
+		s.finish(job, internal.Result{}, internal.ErrQueueFull)
+		return internal.Job{}, internal.ErrQueueFull
+	}
+	logrus.WithField("id", id).Info("job queued")
+	return job, nil
+}
+
+func (s *jobService) Get(id string) (internal.Job, error) {
+	return s.store.Get(id)
+}
+
+// Close stops accepting jobs and waits for queued jobs to finish
+func (s *jobService) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// failPending fails the jobs a previous run left queued or running
+func (s *jobService) failPending() {
+	pending, err := s.store.Pending()
+	if err != nil {
+		logrus.WithError(err).Error("unable to list unfinished jobs")
+		return
+	}
+	for _, job := range pending {
+		s.finish(job, internal.Result{}, internal.ErrJobInterrupted)
+	}
+}
+
+func (s *jobService) work() {
+	defer s.wg.Done()
+	for t := range s.queue {
+		job := t.job
+		job.Status = internal.JobRunning
+		job.UpdatedAt = time.Now().UTC()
+		if err := s.store.Put(job); err != nil {
+			logrus.WithError(err).WithField("id", job.ID).Error("unable to update job")
+		}
+
+		logrus.WithField("id", job.ID).Info("running job")
+		// a job has already been accepted, it waits its turn rather than failing as busy
+		opts := t.opts
+		opts.Background = true
+		result, err := s.predictor.Predict(bytes.NewReader(t.img), opts)
+		s.finish(job, result, err)
+	}
+}
+
+func (s *jobService) finish(job internal.Job, result internal.Result, err error) {
+	job.Status = internal.JobDone
+	job.Predictions = result.Predictions
+	job.Rollup = result.Rollup
+	job.Unknown = result.Unknown
+	if err != nil {
+		logrus.WithError(err).WithField("id", job.ID).Warn("job failed")
+		job.Status = internal.JobFailed
+		job.Error = err.Error()
+	}
+	job.UpdatedAt = time.Now().UTC()
+	if err := s.store.Put(job); err != nil {
+		logrus.WithError(err).WithField("id", job.ID).Error("unable to store job result")
+	}
+	if s.notifier != nil {
+		s.notifier.Notify(job)
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
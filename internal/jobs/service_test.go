@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"io"
+	"nature-id-api/internal"
+	"sync"
+	"testing"
+)
+
+type fakeStore struct {
+	mu   sync.Mutex
+	jobs map[string]internal.Job
+}
+
+func newFakeStore(jobs ...internal.Job) *fakeStore {
+	s := &fakeStore{jobs: make(map[string]internal.Job)}
+	for _, job := range jobs {
+		s.jobs[job.ID] = job
+	}
+	return s
+}
+
+func (s *fakeStore) Put(job internal.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *fakeStore) Get(id string) (internal.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return job, internal.ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (s *fakeStore) Pending() ([]internal.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []internal.Job
+	for _, job := range s.jobs {
+		if job.Status == internal.JobQueued || job.Status == internal.JobRunning {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+type fakePredictor struct{}
+
+func (fakePredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	return internal.Result{Predictions: internal.Predictions{{ID: 1, Name: "robin", Probability: 90}}}, nil
+}
+
+func (fakePredictor) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+	return nil, nil
+}
+
+func (fakePredictor) State() internal.ModelState {
+	return internal.ModelReady
+}
+
+func (fakePredictor) Close() error {
+	return nil
+}
+
+// TestSubmitAfterClose checks jobs submitted during shutdown are refused rather than sent on the
+// closed queue
+func TestSubmitAfterClose(t *testing.T) {
+	s := NewJobService(fakePredictor{}, newFakeStore(), nil, JobConfig{Workers: 1, QueueSize: 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := s.Submit([]byte("img"), internal.PredictOptions{}, ""); err == internal.ErrJobsClosed {
+					return
+				}
+			}
+		}()
+	}
+	s.Close()
+	wg.Wait()
+
+	if _, err := s.Submit([]byte("img"), internal.PredictOptions{}, ""); err != internal.ErrJobsClosed {
+		t.Errorf("submit after close returned %v, want %v", err, internal.ErrJobsClosed)
+	}
+}
+
+// TestPendingJobsFailed checks jobs a previous run left unfinished are failed at startup
+func TestPendingJobsFailed(t *testing.T) {
+	store := newFakeStore(
+		internal.Job{ID: "queued", Status: internal.JobQueued},
+		internal.Job{ID: "running", Status: internal.JobRunning},
+		internal.Job{ID: "done", Status: internal.JobDone},
+	)
+	s := NewJobService(fakePredictor{}, store, nil, JobConfig{Workers: 1, QueueSize: 1})
+	defer s.Close()
+
+	for id, want := range map[string]internal.JobStatus{
+		"queued":  internal.JobFailed,
+		"running": internal.JobFailed,
+		"done":    internal.JobDone,
+	} {
+		job, err := s.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != want {
+			t.Errorf("job %s is %s, want %s", id, job.Status, want)
+		}
+		if want == internal.JobFailed && job.Error != internal.ErrJobInterrupted.Error() {
+			t.Errorf("job %s failed with %q", id, job.Error)
+		}
+	}
+}
+
+// TestSubmitCallbackWithoutNotifier checks callbacks are refused rather than silently dropped when
+// the service has no notifier, jobs without one still run
+func TestSubmitCallbackWithoutNotifier(t *testing.T) {
+	s := NewJobService(fakePredictor{}, newFakeStore(), nil, JobConfig{Workers: 1, QueueSize: 1})
+	defer s.Close()
+
+	if _, err := s.Submit([]byte("img"), internal.PredictOptions{}, "https://example.com/hook"); err != internal.ErrCallbacksDisabled {
+		t.Errorf("submit with a callback returned %v, want %v", err, internal.ErrCallbacksDisabled)
+	}
+	if _, err := s.Submit([]byte("img"), internal.PredictOptions{}, ""); err != nil {
+		t.Errorf("submit without a callback returned %v", err)
+	}
+}
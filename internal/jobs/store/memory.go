@@ -0,0 +1,69 @@
+package store
+
+import (
+	"nature-id-api/internal"
+	"nature-id-api/internal/jobs"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mu        sync.Mutex
+	jobs      map[string]internal.Job
+	retention time.Duration
+}
+
+func NewMemoryStore(retention time.Duration) jobs.Store {
+	s := &memoryStore{
+		jobs:      make(map[string]internal.Job),
+		retention: retention,
+	}
+	go s.evict()
+	return s
+}
+
+func (s *memoryStore) Put(job internal.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (internal.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || s.expired(job, time.Now()) {
+		return internal.Job{}, internal.ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (s *memoryStore) Pending() ([]internal.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []internal.Job
+	for _, job := range s.jobs {
+		if job.Status == internal.JobQueued || job.Status == internal.JobRunning {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+// evict periodically drops jobs past the retention period
+func (s *memoryStore) evict() {
+	for now := range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for id, job := range s.jobs {
+			if s.expired(job, now) {
+				delete(s.jobs, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *memoryStore) expired(job internal.Job, now time.Time) bool {
+	return now.Sub(job.UpdatedAt) > s.retention
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"nature-id-api/internal"
+	"nature-id-api/internal/jobs"
+	"time"
+)
+
+type redisStore struct {
+	client    *redis.Client
+	retention time.Duration
+	// pending is the set of this instance's queued and running job ids
+	pending string
+}
+
+func NewRedisStore(client *redis.Client, retention time.Duration, instance string) jobs.Store {
+	return &redisStore{client: client, retention: retention, pending: "jobs:pending:" + instance}
+}
+
+func (s *redisStore) Put(job internal.Job) error {
+	b, err := json.Marshal(&job)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		// expiry is reset on every update so finished jobs are kept for the full retention period
+		pipe.Set(ctx, key(job.ID), b, s.retention)
+		if job.Status == internal.JobQueued || job.Status == internal.JobRunning {
+			pipe.SAdd(ctx, s.pending, job.ID)
+		} else {
+			pipe.SRem(ctx, s.pending, job.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Get(id string) (job internal.Job, err error) {
+	b, err := s.client.Get(context.Background(), key(id)).Bytes()
+	if err == redis.Nil {
+		return job, internal.ErrJobNotFound
+	}
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal(b, &job)
+	return job, err
+}
+
+func (s *redisStore) Pending() ([]internal.Job, error) {
+	ids, err := s.client.SMembers(context.Background(), s.pending).Result()
+	if err != nil {
+		return nil, err
+	}
+	var pending []internal.Job
+	for _, id := range ids {
+		job, err := s.Get(id)
+		if err == internal.ErrJobNotFound {
+			// expired, nothing left to fail
+			s.client.SRem(context.Background(), s.pending, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, job)
+	}
+	return pending, nil
+}
+
+func key(id string) string {
+	return "job:" + id
+}
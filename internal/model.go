@@ -0,0 +1,28 @@
+package internal
+
+import "errors"
+
+// ErrModelNotFound is returned when a request names a model that isn't registered
+var ErrModelNotFound = errors.New("model not found")
+
+// ModelInfo describes a registered model
+type ModelInfo struct {
+	Name    string         `json:"name"`
+	Default bool           `json:"default"`
+	State   ModelState     `json:"state"`
+	Version string         `json:"version,omitempty"`
+	Path    string         `json:"path"`
+	Labels  int            `json:"labels"`
+	Stats   InferenceStats `json:"stats"`
+}
+
+// ModelRegistry serves several named models side by side, an empty name is the default model
+type ModelRegistry interface {
+	Model(name string) (MonitoredPredictor, error)
+	Info(name string) (ModelInfo, error)
+	// List returns every model in the order they were registered
+	List() []ModelInfo
+	// Reload swaps in a new version of the model, the current one keeps serving if that fails
+	Reload(name string) error
+	Close() error
+}
@@ -1,6 +1,30 @@
 package internal
 
-import "io"
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrInvalidImage is returned when an uploaded image can't be read or decoded
+	ErrInvalidImage = errors.New("invalid image")
+	// ErrUnsupportedFormat is returned when an upload isn't a jpeg, png, gif, webp or bmp image
+	ErrUnsupportedFormat = errors.New("unsupported image format, expected jpeg, png, gif, webp or bmp")
+	// ErrModelUnavailable is returned when the model is still loading or failed to load
+	ErrModelUnavailable = errors.New("model unavailable")
+	// ErrInference is returned when the model fails to run on a valid image
+	ErrInference = errors.New("inference failed")
+)
+
+// ModelState describes the loading progress of a predictor's model
+type ModelState string
+
+const (
+	ModelLoading ModelState = "loading"
+	ModelReady   ModelState = "ready"
+	ModelFailed  ModelState = "failed"
+)
 
 // Prediction type
 type Prediction struct {
@@ -8,15 +32,144 @@ type Prediction struct {
 	Name        string  `json:"name"`
 	DisplayName string  `json:"display_name"`
 	Probability float32 `json:"probability"`
+	// AdjustedProbability is Probability after every adjustment, only set when there are any
+	AdjustedProbability *float32     `json:"adjusted_probability,omitempty"`
+	Adjustments         []Adjustment `json:"adjustments,omitempty"`
+	Box                 *Box         `json:"box,omitempty"`
+	PixelBox            *PixelBox    `json:"pixel_box,omitempty"`
+	Taxonomy            *Taxonomy    `json:"taxonomy,omitempty"`
+}
+
+// Score is the adjusted probability when there is one, otherwise the model's probability
+func (p *Prediction) Score() float32 {
+	if p.AdjustedProbability != nil {
+		return *p.AdjustedProbability
+	}
+	return p.Probability
+}
+
+// Adjust scales the prediction's score, recording why. A factor of 1 changes nothing and is skipped
+// so unadjusted predictions don't get an adjusted_probability
+func (p *Prediction) Adjust(a Adjustment) {
+	if a.Factor == 1 {
+		return
+	}
+	score := p.Score() * a.Factor
+	p.AdjustedProbability = &score
+	p.Adjustments = append(p.Adjustments, a)
+}
+
+// Adjustment explains a change to a prediction's probability made after inference
+type Adjustment struct {
+	Source string  `json:"source"`
+	Factor float32 `json:"factor"`
+	Reason string  `json:"reason"`
+}
+
+// Location is where a photo was taken in decimal degrees
+type Location struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Box is a detection bounding box normalized to the range [0, 1]
+type Box struct {
+	YMin float32 `json:"ymin"`
+	XMin float32 `json:"xmin"`
+	YMax float32 `json:"ymax"`
+	XMax float32 `json:"xmax"`
+}
+
+// PixelBox is a detection bounding box in pixel coordinates of the uploaded image
+type PixelBox struct {
+	YMin int `json:"ymin"`
+	XMin int `json:"xmin"`
+	YMax int `json:"ymax"`
+	XMax int `json:"xmax"`
+}
+
+// ToPixels scales a normalized box to an image of the given size
+func (b Box) ToPixels(width, height int) PixelBox {
+	return PixelBox{
+		YMin: int(b.YMin * float32(height)),
+		XMin: int(b.XMin * float32(width)),
+		YMax: int(b.YMax * float32(height)),
+		XMax: int(b.XMax * float32(width)),
+	}
 }
 
 type Predictions []*Prediction
 
 func (a Predictions) Len() int           { return len(a) }
 func (a Predictions) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a Predictions) Less(i, j int) bool { return a[i].Probability > a[j].Probability }
+func (a Predictions) Less(i, j int) bool { return a[i].Score() > a[j].Score() }
+
+// PredictOptions narrows the predictions returned for an image, zero values use the predictor's defaults
+type PredictOptions struct {
+	// MinProbability is a percentage, the same scale as Prediction.Probability. MinProbability and
+	// Limit are nil when not set, an explicit 0 keeps everything.
+	MinProbability *float32
+	Limit          *int
+	// Include keeps only these label ids, Exclude drops them
+	Include []int
+	Exclude []int
+	// Rollup is the broadest rank probabilities are summed up to, empty disables the rollup
+	Rollup          string
+	RollupThreshold float32
+	// Location overrides the photo's GPS tags for the geographic prior, NoGeo turns the prior off
+	Location *Location
+	NoGeo    bool
+	// Date overrides when the photo's EXIF says it was taken for the seasonal prior, NoSeason turns
+	// the prior off
+	Date     *time.Time
+	NoSeason bool
+	// Background callers, like job workers, wait for a free worker however long it takes instead
+	// of being turned away when the queue is full
+	Background bool
+}
+
+// Result is everything predicted for an image, Rollup is only set when requested and Unknown only
+// when the photo was rejected, in which case there are no predictions
+type Result struct {
+	Predictions Predictions `json:"predictions"`
+	Rollup      *Rollup     `json:"rollup,omitempty"`
+	Unknown     *Unknown    `json:"unknown,omitempty"`
+	// Top is the model's most probable label before priors, rejection or filtering, nil when it
+	// found nothing. It compares models and isn't sent to clients
+	Top *Prediction `json:"-"`
+}
 
+// UnknownHeader is set to true on responses and callbacks for rejected photos, which always get
+// the Result envelope with Unknown set
+const UnknownHeader = "X-Prediction-Unknown"
+
+// Unknown explains why a photo was judged to show nothing the model knows
+type Unknown struct {
+	Rule      string  `json:"rule"`
+	Value     float32 `json:"value"`
+	Threshold float32 `json:"threshold"`
+	Reason    string  `json:"reason"`
+}
+
+// Image is a named upload in a batch
+type Image struct {
+	Name string
+	Body io.Reader
+}
+
+// BatchResult is the outcome of a single image in a batch
+type BatchResult struct {
+	Predictions Predictions `json:"predictions"`
+	Rollup      *Rollup     `json:"rollup,omitempty"`
+	Unknown     *Unknown    `json:"unknown,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Top         *Prediction `json:"-"`
+}
 
 type Predictor interface {
-	Predict(img io.Reader) (Predictions, error)
+	Predict(img io.Reader, opts PredictOptions) (Result, error)
+	// PredictBatch returns results keyed by image name, a failed image doesn't fail the batch
+	PredictBatch(imgs []Image, opts PredictOptions) (map[string]BatchResult, error)
+	State() ModelState
+	Close() error
 }
@@ -0,0 +1,111 @@
+package predictor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"nature-id-api/internal"
+)
+
+// batchImage is a normalized image waiting to be run through the model
+type batchImage struct {
+	name          string
+	tensor        *tensorflow.Tensor
+	width, height int
+	meta          metadata
+}
+
+func (s *tfService) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+
+	m, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer m.release()
+
+	results := make(map[string]internal.BatchResult, len(imgs))
+
+	// The model only takes batches of identically sized images
+	groups := make(map[[2]int64][]batchImage)
+	var order [][2]int64
+	for _, img := range imgs {
+		tensor, width, height, meta, err := s.normalizeImage(img.Body)
+		if err != nil {
+			logrus.WithError(err).WithField("name", img.Name).Warn("unable to make a tensor from image")
+			results[img.Name] = internal.BatchResult{Error: err.Error()}
+			continue
+		}
+		shape := tensor.Shape()
+		key := [2]int64{shape[1], shape[2]}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], batchImage{name: img.Name, tensor: tensor, width: width, height: height, meta: meta})
+	}
+
+	size := s.config.BatchSize
+	if size < 1 {
+		size = 1
+	}
+	for _, key := range order {
+		group := groups[key]
+		for start := 0; start < len(group); start += size {
+			end := start + size
+			if end > len(group) {
+				end = len(group)
+			}
+			s.predictChunk(m, group[start:end], opts, results)
+		}
+	}
+
+	return results, nil
+}
+
+// predictChunk runs same sized images through the model as one tensor
+func (s *tfService) predictChunk(m *model, chunk []batchImage, opts internal.PredictOptions, results map[string]internal.BatchResult) {
+	fail := func(err error) {
+		for _, img := range chunk {
+			results[img.name] = internal.BatchResult{Error: err.Error()}
+		}
+	}
+
+	tensor, err := stackTensors(chunk)
+	if err != nil {
+		fail(fmt.Errorf("%w: %v", internal.ErrInference, err))
+		return
+	}
+	sizes := make([]imageSize, len(chunk))
+	for i, img := range chunk {
+		sizes[i] = imageSize{img.width, img.height}
+	}
+	found, unknown, err := s.infer(m, tensor, sizes)
+	if err != nil {
+		fail(err)
+		return
+	}
+	for i, img := range chunk {
+		result := s.result(m, found[i], unknown[i], img.meta, opts)
+		results[img.name] = internal.BatchResult{
+			Predictions: result.Predictions,
+			Rollup:      result.Rollup,
+			Unknown:     result.Unknown,
+			Top:         result.Top,
+		}
+	}
+}
+
+// stackTensors joins [1, height, width, 3] image tensors into a single [n, height, width, 3] tensor
+func stackTensors(chunk []batchImage) (*tensorflow.Tensor, error) {
+	if len(chunk) == 1 {
+		return chunk[0].tensor, nil
+	}
+	var buf bytes.Buffer
+	for _, img := range chunk {
+		if _, err := img.tensor.WriteContentsTo(&buf); err != nil {
+			return nil, err
+		}
+	}
+	shape := append([]int64{int64(len(chunk))}, chunk[0].tensor.Shape()[1:]...)
+	return tensorflow.ReadTensor(chunk[0].tensor.DataType(), shape, &buf)
+}
@@ -0,0 +1,42 @@
+package predictor
+
+import (
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"reflect"
+	"testing"
+)
+
+// TestStackTensors checks images are stacked in their own type, float32 when the normalization
+// graph scaled them
+func TestStackTensors(t *testing.T) {
+	tests := []struct {
+		images []interface{}
+		want   interface{}
+	}{
+		{
+			[]interface{}{[][][][]uint8{{{{1, 2, 3}}}}, [][][][]uint8{{{{4, 5, 6}}}}},
+			[][][][]uint8{{{{1, 2, 3}}}, {{{4, 5, 6}}}},
+		},
+		{
+			[]interface{}{[][][][]float32{{{{0.5, -1, 2}}}}, [][][][]float32{{{{0, 0.25, 1}}}}},
+			[][][][]float32{{{{0.5, -1, 2}}}, {{{0, 0.25, 1}}}},
+		},
+	}
+	for _, tt := range tests {
+		var chunk []batchImage
+		for _, img := range tt.images {
+			tensor, err := tensorflow.NewTensor(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunk = append(chunk, batchImage{tensor: tensor})
+		}
+		stacked, err := stackTensors(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stacked.Value(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stacked %v, want %v", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package predictor
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"math"
+	"nature-id-api/internal"
+	"time"
+)
+
+// InputConfig is the preprocessing for classification models, images are resized to Width x Height
+// and, when Float is set, fed as float32 (pixel - Mean) / Std per channel instead of uint8
+type InputConfig struct {
+	Width  int
+	Height int
+	Float  bool
+	Mean   [3]float32
+	Std    [3]float32
+}
+
+// classify runs a batch of images through a classification model, returning the calibrated class
+// probabilities for each image in order. Float inputs were already scaled by the normalization graph
+func (s *tfService) classify(m *model, tensor *tensorflow.Tensor) ([][]float32, error) {
+	now := time.Now()
+	logrus.WithFields(logrus.Fields{"batch": tensor.Shape()[0], "version": m.version}).Info("classifying")
+	output, err := m.session.Run(
+		map[tensorflow.Output]*tensorflow.Tensor{
+			m.input: tensor,
+		},
+		[]tensorflow.Output{
+			m.probabilities,
+		},
+		nil)
+	if err != nil {
+		logrus.WithError(err).Error("unable to run model")
+		return nil, fmt.Errorf("%w: %v", internal.ErrInference, err)
+	}
+	logrus.WithField("time", time.Now().Sub(now).String()).Info("classifying complete")
+
+	probabilities, ok := output[0].Value().([][]float32)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a [batch, classes] float output", internal.ErrInference)
+	}
+	for _, p := range probabilities {
+		calibrateClasses(p, m.temperature, s.config.Logits)
+	}
+	return probabilities, nil
+}
+
+// softmax turns logits into probabilities in place
+func softmax(logits []float32) {
+	max := float32(math.Inf(-1))
+	for _, l := range logits {
+		if l > max {
+			max = l
+		}
+	}
+	var sum float64
+	for i, l := range logits {
+		e := math.Exp(float64(l - max))
+		logits[i] = float32(e)
+		sum += e
+	}
+	for i := range logits {
+		logits[i] = float32(float64(logits[i]) / sum)
+	}
+}
+
+// classPredictions builds predictions for every class, class i is label i+offset. They're cut to
+// TopK by filter once priors, include and exclude and the rollup have seen them all
+func (m *model) classPredictions(probabilities []float32, offset int) internal.Predictions {
+	labels := make(internal.Predictions, 0, len(probabilities))
+	for class := range probabilities {
+		label, ok := m.labelMap[class+offset]
+		if !ok {
+			logrus.WithField("id", class+offset).Warn("id does not exist")
+			continue
+		}
+		// label is a copy of the map value, safe to modify
+		label.Probability = probabilities[class] * 100
+		labels = append(labels, &label)
+	}
+	return labels
+}
@@ -0,0 +1,77 @@
+package predictor
+
+import (
+	"nature-id-api/internal"
+	"testing"
+)
+
+// TestClassTopKLast checks classes just outside the top k are still seen by include, the priors and
+// the rollup, and only the result is cut to TopK
+func TestClassTopKLast(t *testing.T) {
+	turdus := func(species string) *internal.Taxonomy {
+		return &internal.Taxonomy{Kingdom: "Animalia", Family: "Turdidae", Genus: "Turdus", Species: species}
+	}
+	ranges, err := parseRanges([]byte(`{"cell_degrees": 1, "labels": {"1": [[40.5, 0.5]], "2": [[40.5, 0.5]]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &model{
+		labelMap: map[int]internal.Prediction{
+			1: {ID: 1, Name: "Sturnus vulgaris", Taxonomy: &internal.Taxonomy{Kingdom: "Animalia", Family: "Sturnidae", Genus: "Sturnus", Species: "vulgaris"}},
+			2: {ID: 2, Name: "Turdus merula", Taxonomy: turdus("merula")},
+			3: {ID: 3, Name: "Turdus philomelos", Taxonomy: turdus("philomelos")},
+			4: {ID: 4, Name: "Turdus pilaris", Taxonomy: turdus("pilaris")},
+		},
+		ranges: ranges,
+	}
+	s := &tfService{config: ModelConfig{
+		Type:              TypeClassification,
+		TopK:              2,
+		LabelOffset:       1,
+		RollupThreshold:   50,
+		RangeNeighbors:    1,
+		RangeAbsentFactor: 0.1,
+	}}
+	limit := 3
+	elsewhere := &internal.Location{Lat: 10.5, Lng: 10.5}
+
+	tests := []struct {
+		name   string
+		opts   internal.PredictOptions
+		want   []int
+		rollup string
+	}{
+		{"top k", internal.PredictOptions{}, []int{1, 2}, ""},
+		{"limit above top k", internal.PredictOptions{Limit: &limit}, []int{1, 2}, ""},
+		{"include outside top k", internal.PredictOptions{Include: []int{4}}, []int{4}, ""},
+		{"exclude", internal.PredictOptions{Exclude: []int{1}}, []int{2, 3}, ""},
+		// 1 and 2 are only recorded far away, 3 and 4 have no range data
+		{"prior promotes", internal.PredictOptions{Location: elsewhere}, []int{3, 4}, ""},
+		// the three thrushes sum to 60, the two in the top k only to 50
+		{"rollup sums every class", internal.PredictOptions{Rollup: "genus"}, []int{1, 2}, "Turdus"},
+	}
+	for _, tt := range tests {
+		labels := m.classPredictions([]float32{0.4, 0.3, 0.2, 0.1}, s.config.LabelOffset)
+		result := s.result(m, labels, nil, metadata{}, tt.opts)
+		var got []int
+		for _, p := range result.Predictions {
+			got = append(got, p.ID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got ids %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got ids %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+		if tt.rollup == "" {
+			continue
+		}
+		if result.Rollup == nil || result.Rollup.Name != tt.rollup || !result.Rollup.Confident || result.Rollup.Probability < 59.9 {
+			t.Errorf("%s: got rollup %+v, want a confident %s at 60", tt.name, result.Rollup, tt.rollup)
+		}
+	}
+}
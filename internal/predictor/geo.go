@@ -0,0 +1,138 @@
+package predictor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math"
+	"nature-id-api/internal"
+	"strconv"
+)
+
+// rangeFile is the gridded range dataset, cells are the [lat, lng] of any point inside a grid cell
+// where the label has been recorded
+//
+//	{"cell_degrees": 1, "labels": {"12": [[47.5, -122.5], [48.5, -122.5]]}}
+type rangeFile struct {
+	CellDegrees float64                `json:"cell_degrees"`
+	Labels      map[string][][]float64 `json:"labels"`
+}
+
+type cell struct {
+	row, col int
+}
+
+// rangeMap records which grid cells each label is known to occur in, labels missing from it have
+// no range data and are never adjusted
+type rangeMap struct {
+	cellDegrees float64
+	cols        int
+	presence    map[int]map[cell]bool
+}
+
+func parseRanges(data []byte) (*rangeMap, error) {
+	var f rangeFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.CellDegrees <= 0 || f.CellDegrees > 180 {
+		return nil, fmt.Errorf("cell_degrees must be between 0 and 180, got %v", f.CellDegrees)
+	}
+	r := &rangeMap{
+		cellDegrees: f.CellDegrees,
+		cols:        int(math.Ceil(360 / f.CellDegrees)),
+		presence:    make(map[int]map[cell]bool, len(f.Labels)),
+	}
+	for key, points := range f.Labels {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label id %q", key)
+		}
+		cells := make(map[cell]bool, len(points))
+		for _, p := range points {
+			if len(p) != 2 {
+				return nil, fmt.Errorf("label %d has a cell without a lat and lng", id)
+			}
+			cells[r.cellOf(internal.Location{Lat: p[0], Lng: p[1]})] = true
+		}
+		r.presence[id] = cells
+	}
+	return r, nil
+}
+
+// cellOf finds the grid cell of a location, longitude 180 is the same meridian as -180 and wraps
+// to the first column
+func (r *rangeMap) cellOf(loc internal.Location) cell {
+	lng := math.Mod(loc.Lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	return cell{
+		row: int(math.Floor((loc.Lat + 90) / r.cellDegrees)),
+		col: int(math.Floor(lng/r.cellDegrees)) % r.cols,
+	}
+}
+
+// nearby reports whether the label has range data and, if so, whether it occurs within radius
+// cells of the location, wrapping around the antimeridian
+func (r *rangeMap) nearby(id int, loc internal.Location, radius int) (known, present bool) {
+	cells, ok := r.presence[id]
+	if !ok {
+		return false, false
+	}
+	center := r.cellOf(loc)
+	for dr := -radius; dr <= radius; dr++ {
+		for dc := -radius; dc <= radius; dc++ {
+			col := ((center.col+dc)%r.cols + r.cols) % r.cols
+			if cells[cell{row: center.row + dr, col: col}] {
+				return true, true
+			}
+		}
+	}
+	return true, false
+}
+
+// loadRanges reads the range dataset next to the model, nil when none is configured
+func (s *tfService) loadRanges() (*rangeMap, error) {
+	if s.config.RangeFile == "" {
+		return nil, nil
+	}
+	path := s.config.Path + s.config.RangeFile
+	logrus.WithField("path", path).Info("downloading range data")
+	data, err := s.bucket.ReadAll(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRanges(data)
+}
+
+// adjustForRange down-weights labels with range data that haven't been recorded near where the
+// photo was taken, the request's location wins over the photo's GPS tags
+func (s *tfService) adjustForRange(m *model, labels internal.Predictions, meta metadata, opts internal.PredictOptions) {
+	if m.ranges == nil || opts.NoGeo {
+		return
+	}
+	location, source := opts.Location, "request"
+	if location == nil {
+		location, source = meta.location, "photo gps"
+	}
+	if location == nil {
+		return
+	}
+
+	// a degree of latitude is about 111 km
+	km := int(float64(s.config.RangeNeighbors)*m.ranges.cellDegrees*111 + m.ranges.cellDegrees*111/2)
+	where := fmt.Sprintf("%.2f,%.2f from the %s", location.Lat, location.Lng, source)
+	for _, l := range labels {
+		known, present := m.ranges.nearby(l.ID, *location, s.config.RangeNeighbors)
+		if !known || present {
+			continue
+		}
+		l.Adjust(internal.Adjustment{
+			Source: "geo",
+			Factor: s.config.RangeAbsentFactor,
+			Reason: fmt.Sprintf("not recorded within about %d km of %s", km, where),
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package predictor
+
+import (
+	"nature-id-api/internal"
+	"strconv"
+	"testing"
+)
+
+func TestCellOfAntimeridian(t *testing.T) {
+	for _, degrees := range []float64{0.5, 1, 7, 180} {
+		r, err := parseRanges([]byte(`{"cell_degrees": ` + strconv.FormatFloat(degrees, 'f', -1, 64) + `, "labels": {}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		east := r.cellOf(internal.Location{Lat: 10, Lng: 180})
+		west := r.cellOf(internal.Location{Lat: 10, Lng: -180})
+		if east != west {
+			t.Errorf("%v degree cells: 180 is in %+v, -180 in %+v", degrees, east, west)
+		}
+		for _, lng := range []float64{-180, -0.5, 0, 179.99, 180} {
+			if c := r.cellOf(internal.Location{Lng: lng}); c.col < 0 || c.col >= r.cols {
+				t.Errorf("%v degree cells: longitude %v is in column %d of %d", degrees, lng, c.col, r.cols)
+			}
+		}
+	}
+}
+
+// TestAdjustForRange checks only labels missing from around the location are adjusted, labels
+// recorded there keep their probability without an adjusted_probability
+func TestAdjustForRange(t *testing.T) {
+	ranges, err := parseRanges([]byte(`{"cell_degrees": 1, "labels": {"1": [[10.5, 179.5]], "2": [[40.5, 0.5]]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &tfService{config: ModelConfig{RangeNeighbors: 1, RangeAbsentFactor: 0.1}}
+	m := &model{ranges: ranges}
+	labels := internal.Predictions{
+		{ID: 1, Probability: 50},
+		{ID: 2, Probability: 40},
+		{ID: 3, Probability: 10},
+	}
+	// across the antimeridian from label 1's cell
+	s.adjustForRange(m, labels, metadata{}, internal.PredictOptions{Location: &internal.Location{Lat: 10.5, Lng: -179.5}})
+
+	if labels[0].AdjustedProbability != nil || len(labels[0].Adjustments) != 0 {
+		t.Errorf("label recorded nearby was adjusted: %+v", labels[0])
+	}
+	if labels[1].AdjustedProbability == nil || *labels[1].AdjustedProbability != 4 || labels[1].Adjustments[0].Factor != 0.1 {
+		t.Errorf("label recorded elsewhere was not adjusted: %+v", labels[1])
+	}
+	if labels[2].AdjustedProbability != nil {
+		t.Errorf("label without range data was adjusted: %+v", labels[2])
+	}
+
+	// an absent factor of 1 changes nothing
+	s.config.RangeAbsentFactor = 1
+	labels = internal.Predictions{{ID: 2, Probability: 40}}
+	s.adjustForRange(m, labels, metadata{}, internal.PredictOptions{Location: &internal.Location{Lat: 10.5, Lng: -179.5}})
+	if labels[0].AdjustedProbability != nil {
+		t.Errorf("factor 1 set an adjusted probability: %+v", labels[0])
+	}
+}
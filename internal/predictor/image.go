@@ -0,0 +1,389 @@
+package predictor
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/sirupsen/logrus"
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"github.com/tensorflow/tensorflow/tensorflow/go/op"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/webp"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"nature-id-api/internal"
+	"net/http"
+	"time"
+)
+
+// Image formats as reported by http.DetectContentType
+const (
+	formatJPEG = "image/jpeg"
+	formatPNG  = "image/png"
+	formatGIF  = "image/gif"
+	formatWebP = "image/webp"
+	formatBMP  = "image/bmp"
+
+	// decodedPixels is the normalization graph for formats decoded in go
+	decodedPixels = "pixels"
+)
+
+// goDecoders decode formats tensorflow has no reliable op for, their pixels are fed to the graph directly
+var goDecoders = map[string]func(io.Reader) (image.Image, error){
+	formatWebP: webp.Decode,
+	formatBMP:  bmp.Decode,
+}
+
+// orientation is the transpose and flips that turn an image stored with an EXIF orientation upright
+type orientation struct {
+	transpose bool
+	flip      []int32 // axes to reverse after transposing, 0 is height and 1 is width
+}
+
+// orientations maps the EXIF Orientation tag values, 1 (already upright) is the zero value
+var orientations = map[int]orientation{
+	2: {flip: []int32{1}},                     // mirrored horizontally
+	3: {flip: []int32{0, 1}},                  // rotated 180
+	4: {flip: []int32{0}},                     // mirrored vertically
+	5: {transpose: true},                      // mirrored horizontally and rotated 270 clockwise
+	6: {transpose: true, flip: []int32{1}},    // rotated 90 clockwise
+	7: {transpose: true, flip: []int32{0, 1}}, // mirrored horizontally and rotated 90 clockwise
+	8: {transpose: true, flip: []int32{0}},    // rotated 270 clockwise
+}
+
+// metadata is what's used from an image's EXIF tags before they're dropped
+type metadata struct {
+	orientation orientation
+	// location is nil when the photo has no GPS tags
+	location *internal.Location
+	// taken is nil when the photo has no DateTimeOriginal or DateTime tag
+	taken *time.Time
+}
+
+// readMetadata reads the EXIF tags of an image, images without EXIF are assumed upright
+func readMetadata(data []byte) metadata {
+	var meta metadata
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return meta
+	}
+	meta.orientation = readOrientation(x)
+	if lat, lng, err := x.LatLong(); err == nil {
+		meta.location = &internal.Location{Lat: lat, Lng: lng}
+	}
+	if taken, err := x.DateTime(); err == nil {
+		meta.taken = &taken
+	}
+	return meta
+}
+
+func readOrientation(x *exif.Exif) orientation {
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return orientation{}
+	}
+	value, err := tag.Int(0)
+	if err != nil {
+		logrus.WithError(err).Warn("invalid exif orientation")
+		return orientation{}
+	}
+	return orientations[value]
+}
+
+// detectFormat sniffs the image format from its content rather than trusting the file name
+func detectFormat(data []byte) (string, error) {
+	format := http.DetectContentType(data)
+	switch format {
+	case formatJPEG, formatPNG, formatGIF, formatWebP, formatBMP:
+		return format, nil
+	}
+	return "", fmt.Errorf("%w: %s", internal.ErrUnsupportedFormat, format)
+}
+
+// normalizeImage returns the image tensor fed to the model along with the size of the upright
+// image before any resizing and the EXIF metadata used after inference
+func (s *tfService) normalizeImage(body io.Reader) (tensor *tensorflow.Tensor, width, height int, meta metadata, err error) {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		return nil, 0, 0, meta, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+	}
+	format, err := detectFormat(buf.Bytes())
+	if err != nil {
+		return nil, 0, 0, meta, err
+	}
+	logrus.WithField("format", format).Info("normalizing image")
+
+	// Header only, the pixels are decoded by the graph
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, 0, 0, meta, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+	}
+	if err := s.checkPixels(imgConfig.Width, imgConfig.Height); err != nil {
+		return nil, 0, 0, meta, err
+	}
+	meta = readMetadata(buf.Bytes())
+	o := meta.orientation
+	width, height = imgConfig.Width, imgConfig.Height
+	if o.transpose {
+		width, height = height, width
+	}
+
+	input, err := inputTensor(format, buf.Bytes())
+	if err != nil {
+		return nil, 0, 0, meta, err
+	}
+
+	perm, flip, err := orientationTensors(o)
+	if err != nil {
+		return nil, 0, 0, meta, fmt.Errorf("%w: %v", internal.ErrInference, err)
+	}
+
+	g := s.normalizers[normalizerFor(format)]
+
+	feeds := map[tensorflow.Output]*tensorflow.Tensor{
+		g.input: input,
+		g.perm:  perm,
+		g.flip:  flip,
+	}
+	output, resized := g.output, g.resized
+	if s.config.Type == TypeClassification && s.config.Input.Float {
+		output, resized = g.scaled, g.resizedScaled
+	}
+	if w, h, ok := s.inputSize(width, height); ok {
+		size, err := tensorflow.NewTensor([]int32{int32(h), int32(w)})
+		if err != nil {
+			return nil, 0, 0, meta, fmt.Errorf("%w: %v", internal.ErrInference, err)
+		}
+		feeds[g.size] = size
+		output = resized
+		logrus.WithFields(logrus.Fields{"width": w, "height": h}).Info("resizing image")
+	}
+
+	// Only pixels are fed forward, any metadata in the upload is dropped here
+	normalized, err := g.session.Run(
+		feeds,
+		[]tensorflow.Output{
+			output,
+		},
+		nil)
+	if err != nil {
+		// the decode op is the only thing that fails on user input
+		return nil, 0, 0, meta, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+	}
+
+	logrus.Info("image normalized")
+	return normalized[0], width, height, meta, nil
+}
+
+// checkPixels refuses images larger than MaxPixels, a small file can declare a size that would take
+// gigabytes to decode
+func (s *tfService) checkPixels(width, height int) error {
+	if max := int64(s.config.MaxPixels); max > 0 && int64(width)*int64(height) > max {
+		return fmt.Errorf("%w: %dx%d is more than %d pixels", internal.ErrInvalidImage, width, height, max)
+	}
+	return nil
+}
+
+// inputSize is the size an image is resized to before inference, ok is false when it's fed as is.
+// Classification models take a fixed size, detection models anything up to MaxDimension.
+func (s *tfService) inputSize(width, height int) (w, h int, ok bool) {
+	if s.config.Type == TypeClassification {
+		w, h = s.config.Input.Width, s.config.Input.Height
+		return w, h, w != width || h != height
+	}
+	return scaleToFit(width, height, s.config.MaxDimension)
+}
+
+// scaleToFit returns the aspect preserving size with the longest side at most limit,
+// ok is false when the image already fits or limit is 0
+func scaleToFit(width, height, limit int) (w, h int, ok bool) {
+	if limit <= 0 || (width <= limit && height <= limit) {
+		return width, height, false
+	}
+	if width >= height {
+		h = height * limit / width
+		if h < 1 {
+			h = 1
+		}
+		return limit, h, true
+	}
+	w = width * limit / height
+	if w < 1 {
+		w = 1
+	}
+	return w, limit, true
+}
+
+// inputTensor builds the tensor fed to the normalization graph, either the encoded
+// bytes or, for formats decoded in go, the raw RGB pixels
+func inputTensor(format string, data []byte) (*tensorflow.Tensor, error) {
+	decode, ok := goDecoders[format]
+	if !ok {
+		tensor, err := tensorflow.NewTensor(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", internal.ErrInference, err)
+		}
+		return tensor, nil
+	}
+
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+	}
+	pixels, width, height := rgbPixels(img)
+	tensor, err := tensorflow.ReadTensor(tensorflow.Uint8, []int64{int64(height), int64(width), 3}, bytes.NewReader(pixels))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", internal.ErrInference, err)
+	}
+	return tensor, nil
+}
+
+// orientationTensors builds the transpose permutation and flip axes fed to the normalization graph
+func orientationTensors(o orientation) (perm, flip *tensorflow.Tensor, err error) {
+	p := []int32{0, 1, 2}
+	if o.transpose {
+		p = []int32{1, 0, 2}
+	}
+	if perm, err = tensorflow.NewTensor(p); err != nil {
+		return nil, nil, err
+	}
+	axes := o.flip
+	if axes == nil {
+		axes = []int32{}
+	}
+	if flip, err = tensorflow.NewTensor(axes); err != nil {
+		return nil, nil, err
+	}
+	return perm, flip, nil
+}
+
+// rgbPixels flattens any color model (grayscale, paletted, alpha) to 3 channel RGB
+func rgbPixels(img image.Image) (pixels []byte, width, height int) {
+	bounds := img.Bounds()
+	width, height = bounds.Dx(), bounds.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+
+	pixels = make([]byte, 0, width*height*3)
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		pixels = append(pixels, rgba.Pix[i], rgba.Pix[i+1], rgba.Pix[i+2])
+	}
+	return pixels, width, height
+}
+
+// normalizeGraph decodes, orients, resizes and normalizes an image to a batch of one 3 channel uint8
+// image, or float32 for classification models taking scaled pixels
+type normalizeGraph struct {
+	graph   *tensorflow.Graph
+	session session // safe for concurrent use, closed with the service
+	input   tensorflow.Output
+	perm    tensorflow.Output // transpose permutation of [height, width, channels]
+	flip    tensorflow.Output // axes to reverse after the transpose
+	output  tensorflow.Output
+
+	// resized is output scaled to size, [height, width]
+	size    tensorflow.Output
+	resized tensorflow.Output
+
+	// scaled and resizedScaled are output and resized as float32 (pixel - mean) / std per channel
+	scaled        tensorflow.Output
+	resizedScaled tensorflow.Output
+}
+
+// normalizerFor returns the normalization graph key used for an image format
+func normalizerFor(format string) string {
+	if _, ok := goDecoders[format]; ok {
+		return decodedPixels
+	}
+	return format
+}
+
+// loadNormalizers builds every normalization graph and its session once, they are shared by all
+// requests to a model and scale float inputs with its mean and std
+func loadNormalizers(input InputConfig) (map[string]*normalizeGraph, error) {
+	normalizers := make(map[string]*normalizeGraph)
+	for _, decoder := range []string{formatJPEG, formatPNG, formatGIF, decodedPixels} {
+		g, err := newNormalizeGraph(decoder, input)
+		if err != nil {
+			closeNormalizers(normalizers)
+			return nil, fmt.Errorf("unable to create %s graph: %w", decoder, err)
+		}
+		normalizers[decoder] = g
+	}
+	return normalizers, nil
+}
+
+func closeNormalizers(normalizers map[string]*normalizeGraph) {
+	for decoder, g := range normalizers {
+		if err := g.session.Close(); err != nil {
+			logrus.WithError(err).WithField("decoder", decoder).Warn("unable to close normalization session")
+		}
+	}
+}
+
+// Creates a graph and session to decode, orient, resize and normalize an image
+func newNormalizeGraph(decoder string, input InputConfig) (*normalizeGraph, error) {
+	scope := op.NewScope()
+	g := &normalizeGraph{}
+
+	var decode tensorflow.Output
+	switch decoder {
+	case formatJPEG:
+		g.input = op.Placeholder(scope, tensorflow.String)
+		decode = op.DecodeJpeg(scope, g.input, op.DecodeJpegChannels(3))
+	case formatPNG:
+		// channels 3 drops alpha and expands grayscale
+		g.input = op.Placeholder(scope, tensorflow.String)
+		decode = op.DecodePng(scope, g.input, op.DecodePngChannels(3))
+	case formatGIF:
+		// gifs decode to [frames, height, width, 3], only the first frame is used
+		g.input = op.Placeholder(scope, tensorflow.String)
+		frames := op.DecodeGif(scope, g.input)
+		decode = op.Gather(scope, frames, op.Const(scope.SubScope("first_frame"), int32(0)))
+	default:
+		// already decoded to RGB pixels
+		g.input = op.Placeholder(scope, tensorflow.Uint8)
+		decode = g.input
+	}
+
+	g.perm = op.Placeholder(scope.SubScope("perm"), tensorflow.Int32)
+	g.flip = op.Placeholder(scope.SubScope("flip"), tensorflow.Int32)
+	upright := op.ReverseV2(scope, op.Transpose(scope, decode, g.perm), g.flip)
+
+	g.output = op.ExpandDims(scope,
+		// cast image to uint8
+		op.Cast(scope, upright, tensorflow.Uint8),
+		op.Const(scope.SubScope("make_batch"), int32(0)))
+
+	// area resizing averages pixels which avoids aliasing when shrinking
+	g.size = op.Placeholder(scope.SubScope("size"), tensorflow.Int32)
+	g.resized = op.Cast(scope.SubScope("resized"),
+		op.ResizeArea(scope, g.output, g.size),
+		tensorflow.Uint8)
+
+	// scaled from the uint8 images so float inputs see the same pixels, the [3] mean and std
+	// broadcast over the channels
+	scale := func(s *op.Scope, pixels tensorflow.Output) tensorflow.Output {
+		mean := op.Const(s.SubScope("mean"), input.Mean[:])
+		std := op.Const(s.SubScope("std"), input.Std[:])
+		return op.Div(s, op.Sub(s, op.Cast(s, pixels, tensorflow.Float), mean), std)
+	}
+	g.scaled = scale(scope.SubScope("scaled"), g.output)
+	g.resizedScaled = scale(scope.SubScope("resized_scaled"), g.resized)
+
+	graph, err := scope.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	session, err := tensorflow.NewSession(graph, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.graph = graph
+	g.session = session
+	return g, nil
+}
@@ -0,0 +1,311 @@
+package predictor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"nature-id-api/internal"
+	"testing"
+)
+
+// The orientation fixtures are a 48x32 image, red, green, blue and white quadrants clockwise from
+// the top left, stored as each EXIF orientation would have a camera store it
+const (
+	uprightWidth  = 48
+	uprightHeight = 32
+)
+
+// testInput scales float inputs to [0, 1], the default
+var testInput = InputConfig{Mean: [3]float32{0, 0, 0}, Std: [3]float32{255, 255, 255}}
+
+var quadrants = []struct {
+	name    string
+	x, y    int
+	r, g, b uint8
+}{
+	{"top left", 12, 8, 255, 0, 0},
+	{"top right", 36, 8, 0, 255, 0},
+	{"bottom right", 36, 24, 255, 255, 255},
+	{"bottom left", 12, 24, 0, 0, 255},
+}
+
+func readFixture(t *testing.T, value int) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(fmt.Sprintf("testdata/orientation/%d.jpg", value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// near allows for jpeg compression
+func near(a, b uint8) bool {
+	d := int(a) - int(b)
+	return d > -48 && d < 48
+}
+
+func checkQuadrants(t *testing.T, value int, pixel func(x, y int) (r, g, b uint8)) {
+	t.Helper()
+	for _, q := range quadrants {
+		r, g, b := pixel(q.x, q.y)
+		if !near(r, q.r) || !near(g, q.g) || !near(b, q.b) {
+			t.Errorf("orientation %d: %s is %d,%d,%d, want %d,%d,%d", value, q.name, r, g, b, q.r, q.g, q.b)
+		}
+	}
+}
+
+// TestReadOrientation checks the orientation table against the fixtures by applying it in go
+func TestReadOrientation(t *testing.T) {
+	for value := 1; value <= 8; value++ {
+		data := readFixture(t, value)
+		o := readMetadata(data).orientation
+		stored, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bounds := stored.Bounds()
+		width, height := bounds.Dx(), bounds.Dy()
+		if o.transpose {
+			width, height = height, width
+		}
+		if width != uprightWidth || height != uprightHeight {
+			t.Errorf("orientation %d: upright size is %dx%d, want %dx%d", value, width, height, uprightWidth, uprightHeight)
+			continue
+		}
+		checkQuadrants(t, value, func(x, y int) (r, g, b uint8) {
+			// undo the flips, then the transpose, to find the stored pixel
+			for _, axis := range o.flip {
+				if axis == 0 {
+					y = height - 1 - y
+				} else {
+					x = width - 1 - x
+				}
+			}
+			if o.transpose {
+				x, y = y, x
+			}
+			r32, g32, b32, _ := stored.At(x, y).RGBA()
+			return uint8(r32 >> 8), uint8(g32 >> 8), uint8(b32 >> 8)
+		})
+	}
+}
+
+// TestNormalizeOrientation runs the fixtures through the normalization graph
+func TestNormalizeOrientation(t *testing.T) {
+	normalizers, err := loadNormalizers(testInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNormalizers(normalizers)
+	s := &tfService{normalizers: normalizers}
+
+	for value := 1; value <= 8; value++ {
+		tensor, width, height, _, err := s.normalizeImage(bytes.NewReader(readFixture(t, value)))
+		if err != nil {
+			t.Fatalf("orientation %d: %v", value, err)
+		}
+		if width != uprightWidth || height != uprightHeight {
+			t.Errorf("orientation %d: size is %dx%d, want %dx%d", value, width, height, uprightWidth, uprightHeight)
+			continue
+		}
+		pixels, ok := tensor.Value().([][][][]uint8)
+		if !ok || len(pixels) != 1 || len(pixels[0]) != uprightHeight || len(pixels[0][0]) != uprightWidth {
+			t.Errorf("orientation %d: unexpected tensor shape %v", value, tensor.Shape())
+			continue
+		}
+		checkQuadrants(t, value, func(x, y int) (r, g, b uint8) {
+			p := pixels[0][y][x]
+			return p[0], p[1], p[2]
+		})
+	}
+}
+
+// TestNormalizeFloat checks classification models taking float inputs get pixels scaled by the graph
+func TestNormalizeFloat(t *testing.T) {
+	input := InputConfig{Width: uprightWidth, Height: uprightHeight, Float: true, Mean: [3]float32{128, 128, 128}, Std: [3]float32{128, 128, 128}}
+	normalizers, err := loadNormalizers(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeNormalizers(normalizers)
+
+	for _, size := range [][2]int{{uprightWidth, uprightHeight}, {uprightWidth / 2, uprightHeight / 2}} {
+		input.Width, input.Height = size[0], size[1]
+		s := &tfService{normalizers: normalizers, config: ModelConfig{Type: TypeClassification, Input: input}}
+		tensor, _, _, _, err := s.normalizeImage(bytes.NewReader(readFixture(t, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pixels, ok := tensor.Value().([][][][]float32)
+		if !ok || len(pixels[0]) != size[1] || len(pixels[0][0]) != size[0] {
+			t.Errorf("%dx%d: unexpected tensor %v %v", size[0], size[1], tensor.DataType(), tensor.Shape())
+			continue
+		}
+		checkQuadrants(t, 1, func(x, y int) (r, g, b uint8) {
+			p := pixels[0][y*size[1]/uprightHeight][x*size[0]/uprightWidth]
+			unscale := func(v float32) uint8 { return uint8(v*128 + 128 + 0.5) }
+			return unscale(p[0]), unscale(p[1]), unscale(p[2])
+		})
+	}
+}
+
+// BenchmarkNormalizeImage normalizes with the graphs built once per service
+func BenchmarkNormalizeImage(b *testing.B) {
+	normalizers, err := loadNormalizers(testInput)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer closeNormalizers(normalizers)
+	s := &tfService{normalizers: normalizers}
+	data, err := ioutil.ReadFile("testdata/orientation/6.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, err := s.normalizeImage(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkNormalizeImageNewGraph builds the graph and session for every image, as was done before
+// they were shared
+func BenchmarkNormalizeImageNewGraph(b *testing.B) {
+	data, err := ioutil.ReadFile("testdata/orientation/6.jpg")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g, err := newNormalizeGraph(formatJPEG, testInput)
+		if err != nil {
+			b.Fatal(err)
+		}
+		s := &tfService{normalizers: map[string]*normalizeGraph{formatJPEG: g}}
+		if _, _, _, _, err := s.normalizeImage(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		g.session.Close()
+	}
+}
+
+func TestScaleToFit(t *testing.T) {
+	tests := []struct {
+		width, height, limit int
+		w, h                 int
+		ok                   bool
+	}{
+		{800, 600, 1024, 800, 600, false},
+		{1024, 1024, 1024, 1024, 1024, false},
+		{4000, 3000, 1024, 1024, 768, true},
+		{3000, 4000, 1024, 768, 1024, true},
+		{2048, 2048, 1024, 1024, 1024, true},
+		{1025, 10, 1024, 1024, 9, true},
+		// never scaled down to nothing
+		{100000, 10, 1024, 1024, 1, true},
+		{10, 100000, 1024, 1, 1024, true},
+		{4000, 3000, 0, 4000, 3000, false},
+	}
+	for _, tt := range tests {
+		w, h, ok := scaleToFit(tt.width, tt.height, tt.limit)
+		if w != tt.w || h != tt.h || ok != tt.ok {
+			t.Errorf("scaleToFit(%d, %d, %d) = %d, %d, %v, want %d, %d, %v",
+				tt.width, tt.height, tt.limit, w, h, ok, tt.w, tt.h, tt.ok)
+		}
+	}
+}
+
+func TestInputSize(t *testing.T) {
+	detection := &tfService{config: ModelConfig{Type: TypeDetection, MaxDimension: 1024}}
+	classification := &tfService{config: ModelConfig{Type: TypeClassification, Input: InputConfig{Width: 224, Height: 224}}}
+	tests := []struct {
+		name          string
+		s             *tfService
+		width, height int
+		w, h          int
+		ok            bool
+	}{
+		{"detection fits", detection, 640, 480, 640, 480, false},
+		{"detection downscaled", detection, 4000, 3000, 1024, 768, true},
+		{"classification resized", classification, 640, 480, 224, 224, true},
+		{"classification as is", classification, 224, 224, 224, 224, false},
+	}
+	for _, tt := range tests {
+		w, h, ok := tt.s.inputSize(tt.width, tt.height)
+		if w != tt.w || h != tt.h || ok != tt.ok {
+			t.Errorf("%s: got %d, %d, %v, want %d, %d, %v", tt.name, w, h, ok, tt.w, tt.h, tt.ok)
+		}
+	}
+}
+
+// TestBoxesInOriginalPixels checks boxes found on a downscaled image come back in pixels of the
+// original upright image
+func TestBoxesInOriginalPixels(t *testing.T) {
+	m := &model{labelMap: map[int]internal.Prediction{1: {ID: 1, Name: "robin"}}}
+	d := detections{
+		scores:  []float32{0.9},
+		classes: []float32{1},
+		num:     1,
+		boxes:   [][]float32{{0.25, 0.5, 0.75, 1}},
+	}
+	tests := []struct {
+		name          string
+		width, height int
+		want          internal.PixelBox
+	}{
+		// fed to the model at 1024x768
+		{"landscape", 4000, 3000, internal.PixelBox{YMin: 750, XMin: 2000, YMax: 2250, XMax: 4000}},
+		// fed to the model at 768x1024
+		{"portrait", 3000, 4000, internal.PixelBox{YMin: 1000, XMin: 1500, YMax: 3000, XMax: 3000}},
+		{"not resized", 640, 480, internal.PixelBox{YMin: 120, XMin: 320, YMax: 360, XMax: 640}},
+	}
+	for _, tt := range tests {
+		labels := m.predictions(d, tt.width, tt.height)
+		if len(labels) != 1 || labels[0].PixelBox == nil {
+			t.Fatalf("%s: got %v", tt.name, labels)
+		}
+		if *labels[0].PixelBox != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *labels[0].PixelBox, tt.want)
+		}
+		if labels[0].Box.XMax != 1 {
+			t.Errorf("%s: normalized box changed to %+v", tt.name, *labels[0].Box)
+		}
+	}
+}
+
+// TestNormalizeImageMaxPixels checks oversized images are refused from their header, before the
+// pixels are decoded
+func TestNormalizeImageMaxPixels(t *testing.T) {
+	data := readFixture(t, 1)
+	tests := []struct {
+		maxPixels int
+		wantErr   bool
+	}{
+		{uprightWidth*uprightHeight - 1, true},
+		{1, true},
+	}
+	for _, tt := range tests {
+		// no normalizers, refusing has to happen before the graph is needed
+		s := &tfService{config: ModelConfig{MaxPixels: tt.maxPixels}}
+		_, _, _, _, err := s.normalizeImage(bytes.NewReader(data))
+		if !errors.Is(err, internal.ErrInvalidImage) {
+			t.Errorf("max %d pixels: got %v, want %v", tt.maxPixels, err, internal.ErrInvalidImage)
+		}
+	}
+
+	s := &tfService{config: ModelConfig{MaxPixels: uprightWidth * uprightHeight}}
+	if err := s.checkPixels(uprightWidth, uprightHeight); err != nil {
+		t.Errorf("image at the limit refused: %v", err)
+	}
+	s.config.MaxPixels = 0
+	if err := s.checkPixels(1<<20, 1<<20); err != nil {
+		t.Errorf("refused with no limit: %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package predictor
+
+import (
+	"fmt"
+	"nature-id-api/internal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label map formats, a JSON array of predictions or an object detection API string_int_label_map.pbtxt
+const (
+	LabelFormatJSON  = "json"
+	LabelFormatPbtxt = "pbtxt"
+)
+
+// labelFormat returns the configured format or picks one by the file extension
+func labelFormat(file, configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if strings.EqualFold(path.Ext(file), ".pbtxt") {
+		return LabelFormatPbtxt
+	}
+	return LabelFormatJSON
+}
+
+// validateLabelIDs rejects label maps with repeated ids or ids missing between the lowest and highest,
+// only pbtxt label maps are checked since JSON labels have always loaded with either
+func validateLabelIDs(labels []internal.Prediction) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	seen := make(map[int]bool, len(labels))
+	var duplicates []int
+	for _, l := range labels {
+		if seen[l.ID] {
+			duplicates = append(duplicates, l.ID)
+		}
+		seen[l.ID] = true
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("label map has duplicate ids %s", formatIDs(duplicates))
+	}
+
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var missing []int
+	for i := 1; i < len(ids); i++ {
+		for id := ids[i-1] + 1; id < ids[i]; id++ {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("label map has gaps, ids %s are missing between %d and %d", formatIDs(missing), ids[0], ids[len(ids)-1])
+	}
+	return nil
+}
+
+// formatIDs lists the first few ids, a broken label map can have thousands
+func formatIDs(ids []int) string {
+	const max = 10
+	var parts []string
+	for i, id := range ids {
+		if i == max {
+			parts = append(parts, fmt.Sprintf("and %d more", len(ids)-max))
+			break
+		}
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parsePbtxtLabels reads the item { id name display_name taxonomy } blocks of a label map in
+// protobuf text format, any other fields are skipped
+func parsePbtxtLabels(data []byte) ([]internal.Prediction, error) {
+	t := &textTokenizer{data: string(data), line: 1}
+	var labels []internal.Prediction
+	for {
+		tok, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok == "" {
+			return labels, nil
+		}
+		if tok != "item" {
+			return nil, t.errorf("expected item, found %q", tok)
+		}
+		label, err := parseItem(t)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+}
+
+// parseItem reads a single item block after its name
+func parseItem(t *textTokenizer) (internal.Prediction, error) {
+	var label internal.Prediction
+	if err := t.expect("{"); err != nil {
+		return label, err
+	}
+	hasID := false
+	for {
+		field, err := t.next()
+		if err != nil {
+			return label, err
+		}
+		switch field {
+		case "}":
+			if !hasID {
+				return label, t.errorf("item %q has no id", label.Name)
+			}
+			return label, nil
+		case "":
+			return label, t.errorf("unterminated item")
+		case "taxonomy":
+			taxonomy, err := parseTaxonomy(t)
+			if err != nil {
+				return label, err
+			}
+			label.Taxonomy = taxonomy
+			continue
+		}
+
+		value, err := t.fieldValue()
+		if err != nil {
+			return label, err
+		}
+		switch field {
+		case "id":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				return label, t.errorf("invalid id %q", value)
+			}
+			label.ID = id
+			hasID = true
+		case "name":
+			label.Name = value
+		case "display_name":
+			label.DisplayName = value
+		}
+	}
+}
+
+// parseTaxonomy reads a taxonomy { kingdom: "" ... species: "" } block, unknown ranks are skipped
+func parseTaxonomy(t *textTokenizer) (*internal.Taxonomy, error) {
+	tok, err := t.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok == ":" {
+		if tok, err = t.next(); err != nil {
+			return nil, err
+		}
+	}
+	if tok != "{" {
+		return nil, t.errorf("expected \"{\", found %q", tok)
+	}
+	taxonomy := &internal.Taxonomy{}
+	for {
+		rank, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		switch rank {
+		case "}":
+			return taxonomy, nil
+		case "":
+			return nil, t.errorf("unterminated taxonomy")
+		}
+		value, err := t.fieldValue()
+		if err != nil {
+			return nil, err
+		}
+		taxonomy.Set(rank, value)
+	}
+}
+
+// textTokenizer splits protobuf text format into names, punctuation and unquoted string values
+type textTokenizer struct {
+	data string
+	pos  int
+	line int
+}
+
+func (t *textTokenizer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", t.line, fmt.Sprintf(format, args...))
+}
+
+func (t *textTokenizer) expect(want string) error {
+	tok, err := t.next()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return t.errorf("expected %q, found %q", want, tok)
+	}
+	return nil
+}
+
+// fieldValue reads the value after a field name, nested messages are skipped and return ""
+func (t *textTokenizer) fieldValue() (string, error) {
+	tok, err := t.next()
+	if err != nil {
+		return "", err
+	}
+	if tok == ":" {
+		if tok, err = t.next(); err != nil {
+			return "", err
+		}
+	}
+	if tok != "{" {
+		return tok, nil
+	}
+	for depth := 1; depth > 0; {
+		tok, err := t.next()
+		if err != nil {
+			return "", err
+		}
+		switch tok {
+		case "{":
+			depth++
+		case "}":
+			depth--
+		case "":
+			return "", t.errorf("unterminated message")
+		}
+	}
+	return "", nil
+}
+
+// next returns the next token, "" at the end of the input
+func (t *textTokenizer) next() (string, error) {
+	t.skipSpace()
+	if t.pos >= len(t.data) {
+		return "", nil
+	}
+	c := t.data[t.pos]
+	switch {
+	case c == '{' || c == '}' || c == ':':
+		t.pos++
+		return string(c), nil
+	case c == '"' || c == '\'':
+		return t.quoted(c)
+	}
+	start := t.pos
+	for t.pos < len(t.data) && !strings.ContainsRune(" \t\r\n{}:\"'#", rune(t.data[t.pos])) {
+		t.pos++
+	}
+	if t.pos == start {
+		return "", t.errorf("unexpected %q", c)
+	}
+	return t.data[start:t.pos], nil
+}
+
+func (t *textTokenizer) skipSpace() {
+	for t.pos < len(t.data) {
+		switch t.data[t.pos] {
+		case '\n':
+			t.line++
+		case ' ', '\t', '\r':
+		case '#':
+			for t.pos < len(t.data) && t.data[t.pos] != '\n' {
+				t.pos++
+			}
+			continue
+		default:
+			return
+		}
+		t.pos++
+	}
+}
+
+// quoted reads a single or double quoted string, escapes follow the same rules as go
+func (t *textTokenizer) quoted(quote byte) (string, error) {
+	start := t.pos
+	t.pos++
+	for t.pos < len(t.data) && t.data[t.pos] != quote {
+		switch t.data[t.pos] {
+		case '\\':
+			t.pos++
+		case '\n':
+			return "", t.errorf("newline in string")
+		}
+		t.pos++
+	}
+	if t.pos >= len(t.data) {
+		return "", t.errorf("unterminated string")
+	}
+	t.pos++
+
+	// go only allows \' in single quoted runes and " unescaped in back quoted strings, the escapes
+	// are walked in pairs so an escaped backslash is never taken as escaping what follows it
+	raw := t.data[start+1 : t.pos-1]
+	var body strings.Builder
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case c == '\\' && i+1 < len(raw):
+			i++
+			if raw[i] != '\'' {
+				body.WriteByte('\\')
+			}
+			body.WriteByte(raw[i])
+		case c == '"':
+			body.WriteString(`\"`)
+		default:
+			body.WriteByte(c)
+		}
+	}
+	value, err := strconv.Unquote(`"` + body.String() + `"`)
+	if err != nil {
+		return "", t.errorf("invalid string %s", t.data[start:t.pos])
+	}
+	return value, nil
+}
@@ -0,0 +1,94 @@
+package predictor
+
+import (
+	"context"
+	"nature-id-api/internal/storage"
+	"strings"
+	"testing"
+)
+
+func TestQuoted(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`"robin"`, `robin`},
+		{`'robin'`, `robin`},
+		{`"O'Brien's"`, `O'Brien's`},
+		{`"O\'Brien"`, `O'Brien`},
+		{`'say "hi"'`, `say "hi"`},
+		{`'say \"hi\"'`, `say "hi"`},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"C:\\"`, `C:\`},
+		// an escaped backslash then a quote, the quote isn't escaped by the second backslash
+		{`"a\\'b"`, `a\'b`},
+		{`'a\\\'b'`, `a\'b`},
+		{`"tab\there"`, "tab\there"},
+		{`"caf\303\251"`, "café"},
+	}
+	for _, tt := range tests {
+		tok := &textTokenizer{data: tt.in, line: 1}
+		got, err := tok.quoted(tt.in[0])
+		if err != nil {
+			t.Errorf("quoted(%s): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("quoted(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{`"unterminated`, "\"new\nline\"", `"bad \q escape"`} {
+		tok := &textTokenizer{data: in, line: 1}
+		if got, err := tok.quoted(in[0]); err == nil {
+			t.Errorf("quoted(%s) = %q, want an error", in, got)
+		}
+	}
+}
+
+func TestLoadLabelMapFormats(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := storage.NewBucketStorage(storage.BucketConfig{ConnectionString: "mem://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	files := map[string]string{
+		// ids with a gap and a duplicate, as JSON label files have always been allowed
+		"labels.json":  `[{"id": 1, "name": "robin"}, {"id": 3, "name": "wren"}, {"id": 3, "name": "wren"}]`,
+		"labels.pbtxt": "item { id: 1 name: 'robin' }\nitem { id: 3 name: 'wren' }\n",
+	}
+	for key, data := range files {
+		if err := bucket.WriteAll(ctx, key, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file, format string
+		labels       int
+		err          string
+	}{
+		{"labels.json", "", 2, ""},
+		{"labels.json", LabelFormatJSON, 2, ""},
+		{"labels.pbtxt", "", 0, "gaps"},
+		{"labels.json", "yaml", 0, "unknown label format"},
+	}
+	for _, tt := range tests {
+		s := &tfService{bucket: bucket, config: ModelConfig{LabelFormat: tt.format}}
+		labels, err := s.loadLabelMap(tt.file)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s as %q: got %v, want an error containing %q", tt.file, tt.format, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s as %q: %v", tt.file, tt.format, err)
+			continue
+		}
+		if len(labels) != tt.labels {
+			t.Errorf("%s as %q: got %d labels, want %d", tt.file, tt.format, len(labels), tt.labels)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package predictor
+
+import (
+	"context"
+	"golang.org/x/sync/semaphore"
+	"io"
+	"nature-id-api/internal"
+	"sync"
+	"time"
+)
+
+// limitedPredictor bounds how many images are predicted at once, callers beyond that wait in a
+// bounded queue and are turned away once it's full. A batch holds a worker per image. Background
+// callers wait outside the queue for as long as it takes.
+type limitedPredictor struct {
+	internal.Predictor
+	workers   int64
+	sem       *semaphore.Weighted
+	queueSize int
+	timeout   time.Duration
+
+	mu        sync.Mutex
+	running   int64
+	queued    int64
+	jobs      int64
+	started   int64
+	completed int64
+	rejected  int64
+	totalWait time.Duration
+	maxWait   time.Duration
+	totalRun  time.Duration
+}
+
+func NewLimitedPredictor(p internal.Predictor, config ModelConfig) internal.MonitoredPredictor {
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	return &limitedPredictor{
+		Predictor: p,
+		workers:   int64(workers),
+		sem:       semaphore.NewWeighted(int64(workers)),
+		queueSize: config.QueueSize,
+		timeout:   config.QueueTimeout,
+	}
+}
+
+func (l *limitedPredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	release, err := l.acquire(1, opts.Background)
+	if err != nil {
+		return internal.Result{}, err
+	}
+	defer release()
+	return l.Predictor.Predict(img, opts)
+}
+
+func (l *limitedPredictor) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+	release, err := l.acquire(l.weight(len(imgs)), opts.Background)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.Predictor.PredictBatch(imgs, opts)
+}
+
+// weight is how many workers a batch holds, one per image but never more than there are
+func (l *limitedPredictor) weight(images int) int64 {
+	w := int64(images)
+	if w < 1 {
+		w = 1
+	}
+	if w > l.workers {
+		w = l.workers
+	}
+	return w
+}
+
+// acquire waits for weight free workers, the returned func must be called once the prediction is
+// done. Waiting callers are served in order.
+func (l *limitedPredictor) acquire(weight int64, background bool) (func(), error) {
+	start := time.Now()
+	if l.sem.TryAcquire(weight) {
+		return l.run(start, weight), nil
+	}
+	if background {
+		return l.wait(start, weight)
+	}
+
+	l.mu.Lock()
+	if l.queued >= int64(l.queueSize) {
+		l.rejected++
+		l.mu.Unlock()
+		return nil, l.busy()
+	}
+	l.queued++
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	err := l.sem.Acquire(ctx, weight)
+	l.mu.Lock()
+	l.queued--
+	if err != nil {
+		l.rejected++
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return nil, l.busy()
+	}
+	return l.run(start, weight), nil
+}
+
+// wait blocks until weight workers are free, without a queue bound or timeout
+func (l *limitedPredictor) wait(start time.Time, weight int64) (func(), error) {
+	l.mu.Lock()
+	l.jobs++
+	l.mu.Unlock()
+	err := l.sem.Acquire(context.Background(), weight)
+	l.mu.Lock()
+	l.jobs--
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return l.run(start, weight), nil
+}
+
+// run records the time spent waiting and returns the func that frees the workers
+func (l *limitedPredictor) run(queuedAt time.Time, weight int64) func() {
+	runAt := time.Now()
+	wait := runAt.Sub(queuedAt)
+	l.mu.Lock()
+	l.running += weight
+	l.started++
+	l.totalWait += wait
+	if wait > l.maxWait {
+		l.maxWait = wait
+	}
+	l.mu.Unlock()
+
+	return func() {
+		l.sem.Release(weight)
+		l.mu.Lock()
+		l.running -= weight
+		l.completed++
+		l.totalRun += time.Since(runAt)
+		l.mu.Unlock()
+	}
+}
+
+// busy estimates when a worker should be free from the average run time and queue depth
+func (l *limitedPredictor) busy() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	retryAfter := time.Second
+	if l.completed > 0 {
+		average := l.totalRun / time.Duration(l.completed)
+		estimate := average * time.Duration(l.queued+1) / time.Duration(l.workers)
+		if estimate > retryAfter {
+			retryAfter = estimate
+		}
+	}
+	return &internal.BusyError{RetryAfter: retryAfter}
+}
+
+func (l *limitedPredictor) Stats() internal.InferenceStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := internal.InferenceStats{
+		Workers:    int(l.workers),
+		Running:    int(l.running),
+		Queued:     l.queued,
+		QueuedJobs: l.jobs,
+		QueueSize:  l.queueSize,
+		Completed:  l.completed,
+		Rejected:   l.rejected,
+		MaxWaitMS:  milliseconds(l.maxWait),
+	}
+	if l.started > 0 {
+		stats.AverageWaitMS = milliseconds(l.totalWait) / float64(l.started)
+	}
+	if l.completed > 0 {
+		stats.AverageRunMS = milliseconds(l.totalRun) / float64(l.completed)
+	}
+	return stats
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
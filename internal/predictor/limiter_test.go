@@ -0,0 +1,141 @@
+package predictor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"nature-id-api/internal"
+	"testing"
+	"time"
+)
+
+// blockingPredictor holds every prediction until release is closed
+type blockingPredictor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingPredictor() *blockingPredictor {
+	return &blockingPredictor{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (p *blockingPredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	p.started <- struct{}{}
+	<-p.release
+	return internal.Result{}, nil
+}
+
+func (p *blockingPredictor) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+	p.started <- struct{}{}
+	<-p.release
+	return nil, nil
+}
+
+func (p *blockingPredictor) State() internal.ModelState {
+	return internal.ModelReady
+}
+
+func (p *blockingPredictor) Close() error {
+	return nil
+}
+
+func images(n int) []internal.Image {
+	imgs := make([]internal.Image, n)
+	for i := range imgs {
+		imgs[i] = internal.Image{Name: string(rune('a' + i)), Body: bytes.NewReader(nil)}
+	}
+	return imgs
+}
+
+// TestLimiterBatchWeight checks a batch holds a worker per image, up to every worker
+func TestLimiterBatchWeight(t *testing.T) {
+	tests := []struct {
+		images  int
+		running int
+		busy    bool
+	}{
+		{1, 1, false},
+		{3, 3, false},
+		{4, 4, true},
+		{100, 4, true},
+	}
+	for _, tt := range tests {
+		p := newBlockingPredictor()
+		l := NewLimitedPredictor(p, ModelConfig{Workers: 4, QueueSize: 0, QueueTimeout: time.Second})
+
+		done := make(chan struct{})
+		go func() {
+			l.PredictBatch(images(tt.images), internal.PredictOptions{})
+			close(done)
+		}()
+		<-p.started
+		if running := l.Stats().Running; running != tt.running {
+			t.Errorf("batch of %d holds %d workers, want %d", tt.images, running, tt.running)
+		}
+
+		// with no queue a single prediction only runs if a worker is left
+		errs := make(chan error, 1)
+		go func() {
+			_, err := l.Predict(bytes.NewReader(nil), internal.PredictOptions{})
+			errs <- err
+		}()
+		if tt.busy {
+			if err := <-errs; !errors.Is(err, internal.ErrBusy) {
+				t.Errorf("batch of %d: got %v, want busy", tt.images, err)
+			}
+		} else {
+			<-p.started
+		}
+		close(p.release)
+		<-done
+		if !tt.busy {
+			if err := <-errs; err != nil {
+				t.Errorf("batch of %d: %v", tt.images, err)
+			}
+		}
+		if running := l.Stats().Running; running != 0 {
+			t.Errorf("batch of %d: %d workers still held", tt.images, running)
+		}
+	}
+}
+
+// TestLimiterBackground checks background predictions wait for a worker when the queue is full
+// instead of being turned away
+func TestLimiterBackground(t *testing.T) {
+	p := newBlockingPredictor()
+	l := NewLimitedPredictor(p, ModelConfig{Workers: 1, QueueSize: 0, QueueTimeout: time.Millisecond})
+
+	errs := make(chan error, 4)
+	predict := func(opts internal.PredictOptions) {
+		_, err := l.Predict(bytes.NewReader(nil), opts)
+		errs <- err
+	}
+	go predict(internal.PredictOptions{})
+	<-p.started
+
+	go predict(internal.PredictOptions{})
+	if err := <-errs; !errors.Is(err, internal.ErrBusy) {
+		t.Fatalf("request with a full queue: got %v, want busy", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		go predict(internal.PredictOptions{Background: true})
+	}
+	deadline := time.Now().Add(time.Second)
+	for l.Stats().QueuedJobs != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := l.Stats(); stats.QueuedJobs != 2 || stats.Queued != 0 {
+		t.Fatalf("got %d jobs and %d requests queued, want 2 and 0", stats.QueuedJobs, stats.Queued)
+	}
+
+	close(p.release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("prediction %d: %v", i, err)
+		}
+	}
+	if stats := l.Stats(); stats.Rejected != 1 || stats.Completed != 3 {
+		t.Errorf("got %d rejected and %d completed, want 1 and 3", stats.Rejected, stats.Completed)
+	}
+}
@@ -0,0 +1,160 @@
+package predictor
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"nature-id-api/internal"
+	"strings"
+)
+
+// defaultModelName is used when MODELS isn't set, the model is configured with the MODEL_ variables
+const defaultModelName = "default"
+
+// RegistryConfig lists the models to serve, each configured with MODEL_<NAME>_ variables that fall
+// back to the shared MODEL_ ones, e.g. MODEL_BIRDS_PATH
+type RegistryConfig struct {
+	// Names keeps the order models are listed in
+	Names   []string
+	Default string
+	Models  map[string]ModelConfig
+}
+
+func LoadRegistryConfig() (RegistryConfig, error) {
+	var names []string
+	for _, name := range strings.Split(GetEnv("MODELS", defaultModelName), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{defaultModelName}
+	}
+
+	models := make(map[string]ModelConfig, len(names))
+	for _, name := range names {
+		config, err := loadModelConfig(name)
+		if err != nil {
+			return RegistryConfig{}, fmt.Errorf("invalid config for model %s: %w", name, err)
+		}
+		models[name] = config
+	}
+	return RegistryConfig{
+		Names:   names,
+		Default: GetEnv("DEFAULT_MODEL", names[0]),
+		Models:  models,
+	}, nil
+}
+
+// registeredModel is a model along with the limiter requests go through
+type registeredModel struct {
+	config    ModelConfig
+	service   *tfService
+	predictor internal.MonitoredPredictor
+}
+
+type registry struct {
+	names  []string
+	def    string
+	models map[string]*registeredModel
+}
+
+// NewModelRegistry starts loading every model in the background, each gets its own workers and queue
+func NewModelRegistry(bucket Bucket, config RegistryConfig) (internal.ModelRegistry, error) {
+	r := &registry{
+		def:    config.Default,
+		models: make(map[string]*registeredModel, len(config.Names)),
+	}
+	for _, name := range config.Names {
+		if _, ok := r.models[name]; ok {
+			r.Close()
+			return nil, fmt.Errorf("model %s is listed twice", name)
+		}
+		modelConfig := config.Models[name]
+		s, err := newTensorflowService(bucket, modelConfig)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("unable to create model %s: %w", name, err)
+		}
+		r.names = append(r.names, name)
+		r.models[name] = &registeredModel{
+			config:    modelConfig,
+			service:   s,
+			predictor: NewLimitedPredictor(s, modelConfig),
+		}
+		logrus.WithFields(logrus.Fields{"model": name, "path": modelConfig.GetModelPath()}).Info("registered model")
+	}
+	if _, ok := r.models[r.def]; !ok {
+		r.Close()
+		return nil, fmt.Errorf("default model %s is not one of the listed models", r.def)
+	}
+	return r, nil
+}
+
+func (r *registry) get(name string) (*registeredModel, error) {
+	if name == "" {
+		name = r.def
+	}
+	m, ok := r.models[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", internal.ErrModelNotFound, name)
+	}
+	return m, nil
+}
+
+func (r *registry) Model(name string) (internal.MonitoredPredictor, error) {
+	m, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.predictor, nil
+}
+
+func (r *registry) Info(name string) (internal.ModelInfo, error) {
+	if name == "" {
+		name = r.def
+	}
+	m, err := r.get(name)
+	if err != nil {
+		return internal.ModelInfo{}, err
+	}
+	return internal.ModelInfo{
+		Name:    name,
+		Default: name == r.def,
+		State:   m.service.State(),
+		Version: m.service.Version(),
+		Path:    m.config.GetModelPath(),
+		Labels:  m.service.labels(),
+		Stats:   m.predictor.Stats(),
+	}, nil
+}
+
+func (r *registry) List() []internal.ModelInfo {
+	infos := make([]internal.ModelInfo, 0, len(r.names))
+	for _, name := range r.names {
+		info, _ := r.Info(name)
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (r *registry) Reload(name string) error {
+	m, err := r.get(name)
+	if err != nil {
+		return err
+	}
+	return m.service.Reload()
+}
+
+// Close releases every model, returning the first error
+func (r *registry) Close() error {
+	var first error
+	for name, m := range r.models {
+		if err := m.service.Close(); err != nil {
+			logrus.WithError(err).WithField("model", name).Warn("unable to close model")
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
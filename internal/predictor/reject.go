@@ -0,0 +1,139 @@
+package predictor
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"math"
+	"nature-id-api/internal"
+	"nature-id-api/internal/calibration"
+)
+
+// Rejection rules deciding a photo shows nothing the model knows, an empty rule never rejects
+const (
+	RejectMaxProbability = "max_probability"
+	RejectEntropy        = "entropy"
+)
+
+// loadCalibration reads the temperature next to the model, 1 leaves scores as they are
+func (s *tfService) loadCalibration() (float32, error) {
+	if s.config.CalibrationFile == "" {
+		return 1, nil
+	}
+	path := s.config.Path + s.config.CalibrationFile
+	logrus.WithField("path", path).Info("downloading calibration")
+	data, err := s.bucket.ReadAll(context.Background(), path)
+	if err != nil {
+		return 0, err
+	}
+	params, err := calibration.Parse(data)
+	if err != nil {
+		return 0, err
+	}
+	return params.Temperature, nil
+}
+
+// checkReject rejects rules that don't exist or can't be applied to the model type
+func checkReject(rule, modelType string) error {
+	switch rule {
+	case "", RejectMaxProbability:
+		return nil
+	case RejectEntropy:
+		if modelType != TypeClassification {
+			return fmt.Errorf("%s rejection needs a classification model", rule)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown rejection rule %s", rule)
+}
+
+// calibrateClasses applies the temperature to a classification output in place, turning logits or
+// probabilities into calibrated probabilities
+func calibrateClasses(output []float32, temperature float32, logits bool) {
+	if !logits {
+		if temperature == 1 {
+			return
+		}
+		// scaling log probabilities is the same as scaling the logits they came from
+		for i, p := range output {
+			output[i] = float32(math.Log(math.Max(float64(p), 1e-12)))
+		}
+	}
+	for i := range output {
+		output[i] /= temperature
+	}
+	softmax(output)
+}
+
+// calibrateScores applies the temperature to independent detection scores in place
+func calibrateScores(scores []float32, temperature float32) {
+	if temperature == 1 {
+		return
+	}
+	for i, p := range scores {
+		p64 := math.Min(math.Max(float64(p), 1e-12), 1-1e-12)
+		logit := math.Log(p64/(1-p64)) / float64(temperature)
+		scores[i] = float32(1 / (1 + math.Exp(-logit)))
+	}
+}
+
+// entropy is the entropy of a probability distribution divided by its maximum, 0 when one class
+// has everything and 1 when every class is as likely
+func entropy(probabilities []float32) float32 {
+	if len(probabilities) < 2 {
+		return 0
+	}
+	var h float64
+	for _, p := range probabilities {
+		if p > 0 {
+			h -= float64(p) * math.Log(float64(p))
+		}
+	}
+	return float32(h / math.Log(float64(len(probabilities))))
+}
+
+// rejectClasses applies the configured rule to a calibrated classification output
+func (s *tfService) rejectClasses(probabilities []float32) *internal.Unknown {
+	if s.config.Reject == RejectEntropy {
+		h := entropy(probabilities)
+		if h <= s.config.RejectMaxEntropy {
+			return nil
+		}
+		return &internal.Unknown{
+			Rule:      RejectEntropy,
+			Value:     h,
+			Threshold: s.config.RejectMaxEntropy,
+			Reason:    fmt.Sprintf("normalized entropy %.2f is above %.2f", h, s.config.RejectMaxEntropy),
+		}
+	}
+	var max float32
+	for _, p := range probabilities {
+		if p > max {
+			max = p
+		}
+	}
+	return s.rejectMax(max * 100)
+}
+
+// rejectDetections applies the max probability rule to the calibrated detection scores
+func (s *tfService) rejectDetections(d detections) *internal.Unknown {
+	var max float32
+	for i := 0; i < d.num && i < len(d.scores); i++ {
+		if d.scores[i] > max {
+			max = d.scores[i]
+		}
+	}
+	return s.rejectMax(max * 100)
+}
+
+func (s *tfService) rejectMax(max float32) *internal.Unknown {
+	if s.config.Reject != RejectMaxProbability || max >= s.config.RejectMinProbability {
+		return nil
+	}
+	return &internal.Unknown{
+		Rule:      RejectMaxProbability,
+		Value:     max,
+		Threshold: s.config.RejectMinProbability,
+		Reason:    fmt.Sprintf("top probability %.1f%% is below %.1f%%", max, s.config.RejectMinProbability),
+	}
+}
@@ -0,0 +1,157 @@
+package predictor
+
+import (
+	"math"
+	"os"
+	"testing"
+)
+
+func closeTo(got, want []float32) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(float64(got[i]-want[i])) > 1e-5 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCalibrateClasses(t *testing.T) {
+	ln3 := float32(math.Log(3))
+	tests := []struct {
+		name        string
+		output      []float32
+		temperature float32
+		logits      bool
+		want        []float32
+	}{
+		{"logits", []float32{ln3, 0}, 1, true, []float32{0.75, 0.25}},
+		{"scaled logits", []float32{2 * ln3, 0}, 2, true, []float32{0.75, 0.25}},
+		{"sharpened logits", []float32{ln3 / 2, 0}, 0.5, true, []float32{0.75, 0.25}},
+		{"probabilities untouched", []float32{0.9, 0.1}, 1, false, []float32{0.9, 0.1}},
+		{"probabilities", []float32{0.9, 0.1}, 2, false, []float32{0.75, 0.25}},
+		{"zero probability", []float32{1, 0}, 2, false, []float32{1, 0}},
+	}
+	for _, tt := range tests {
+		calibrateClasses(tt.output, tt.temperature, tt.logits)
+		if !closeTo(tt.output, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.output, tt.want)
+		}
+	}
+}
+
+func TestCalibrateScores(t *testing.T) {
+	tests := []struct {
+		name        string
+		scores      []float32
+		temperature float32
+		want        []float32
+	}{
+		{"untouched", []float32{0.8, 0.3}, 1, []float32{0.8, 0.3}},
+		{"softened", []float32{0.8, 0.2, 0.5}, 2, []float32{2.0 / 3, 1.0 / 3, 0.5}},
+		{"sharpened", []float32{2.0 / 3, 1.0 / 3}, 0.5, []float32{0.8, 0.2}},
+		{"certain", []float32{1, 0}, 2, []float32{1, 0}},
+	}
+	for _, tt := range tests {
+		calibrateScores(tt.scores, tt.temperature)
+		if !closeTo(tt.scores, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.scores, tt.want)
+		}
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	tests := []struct {
+		probabilities []float32
+		want          float32
+	}{
+		{[]float32{1}, 0},
+		{[]float32{1, 0, 0}, 0},
+		{[]float32{0.5, 0.5}, 1},
+		{[]float32{0.25, 0.25, 0.25, 0.25}, 1},
+		{[]float32{0.5, 0.5, 0, 0}, 0.5},
+	}
+	for _, tt := range tests {
+		if got := entropy(tt.probabilities); math.Abs(float64(got-tt.want)) > 1e-5 {
+			t.Errorf("entropy(%v) = %v, want %v", tt.probabilities, got, tt.want)
+		}
+	}
+}
+
+func TestCheckReject(t *testing.T) {
+	tests := []struct {
+		rule      string
+		modelType string
+		wantErr   bool
+	}{
+		{"", TypeDetection, false},
+		{RejectMaxProbability, TypeDetection, false},
+		{RejectMaxProbability, TypeClassification, false},
+		{RejectEntropy, TypeClassification, false},
+		{RejectEntropy, TypeDetection, true},
+		{"min_probability", TypeClassification, true},
+	}
+	for _, tt := range tests {
+		if err := checkReject(tt.rule, tt.modelType); (err != nil) != tt.wantErr {
+			t.Errorf("checkReject(%q, %s) returned %v, want error %v", tt.rule, tt.modelType, err, tt.wantErr)
+		}
+	}
+}
+
+func TestLoadModelConfigReject(t *testing.T) {
+	defer os.Unsetenv("MODEL_REJECT_TEST_REJECT")
+	defer os.Unsetenv("MODEL_REJECT_TEST_TYPE")
+	os.Setenv("MODEL_REJECT_TEST_TYPE", TypeDetection)
+	os.Setenv("MODEL_REJECT_TEST_REJECT", RejectEntropy)
+	if _, err := loadModelConfig("reject_test"); err == nil {
+		t.Error("entropy rejection accepted for a detection model")
+	}
+	os.Setenv("MODEL_REJECT_TEST_TYPE", TypeClassification)
+	if _, err := loadModelConfig("reject_test"); err != nil {
+		t.Errorf("entropy rejection refused for a classification model: %v", err)
+	}
+}
+
+func TestReject(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        ModelConfig
+		probabilities []float32
+		wantRule      string
+	}{
+		{"no rule", ModelConfig{}, []float32{0.1, 0.1, 0.8}, ""},
+		{"no rule uncertain", ModelConfig{}, []float32{0.34, 0.33, 0.33}, ""},
+		{"confident", ModelConfig{Reject: RejectMaxProbability, RejectMinProbability: 50}, []float32{0.2, 0.8}, ""},
+		{"at threshold", ModelConfig{Reject: RejectMaxProbability, RejectMinProbability: 50}, []float32{0.5, 0.5}, ""},
+		{"unsure", ModelConfig{Reject: RejectMaxProbability, RejectMinProbability: 50}, []float32{0.3, 0.3, 0.4}, RejectMaxProbability},
+		{"low entropy", ModelConfig{Reject: RejectEntropy, RejectMaxEntropy: 0.8}, []float32{1, 0, 0, 0}, ""},
+		{"spread out", ModelConfig{Reject: RejectEntropy, RejectMaxEntropy: 0.8}, []float32{0.25, 0.25, 0.25, 0.25}, RejectEntropy},
+		// half the maximum entropy
+		{"at entropy", ModelConfig{Reject: RejectEntropy, RejectMaxEntropy: 0.5}, []float32{0.5, 0.5, 0, 0}, ""},
+	}
+	for _, tt := range tests {
+		s := &tfService{config: tt.config}
+		unknown := s.rejectClasses(tt.probabilities)
+		if unknown == nil {
+			if tt.wantRule != "" {
+				t.Errorf("%s: not rejected, want %s", tt.name, tt.wantRule)
+			}
+			continue
+		}
+		if unknown.Rule != tt.wantRule {
+			t.Errorf("%s: rejected by %s, want %q", tt.name, unknown.Rule, tt.wantRule)
+		}
+	}
+
+	s := &tfService{config: ModelConfig{Reject: RejectMaxProbability, RejectMinProbability: 50}}
+	// scores past num are padding and don't count
+	unknown := s.rejectDetections(detections{scores: []float32{0.4, 0.9}, num: 1})
+	if unknown == nil || unknown.Value != 40 || unknown.Threshold != 50 {
+		t.Errorf("rejectDetections = %+v, want 40 below 50", unknown)
+	}
+	if s.rejectDetections(detections{scores: []float32{0.4, 0.9}, num: 2}) != nil {
+		t.Error("a 90% detection was rejected")
+	}
+}
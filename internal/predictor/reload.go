@@ -0,0 +1,308 @@
+package predictor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"nature-id-api/internal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// session runs a graph, it's a *tensorflow.Session except in tests
+type session interface {
+	Run(feeds map[tensorflow.Output]*tensorflow.Tensor, fetches []tensorflow.Output, targets []*tensorflow.Operation) ([]*tensorflow.Tensor, error)
+	Close() error
+}
+
+// model is one loaded version of the graph and its labels, it's replaced as a whole on reload
+type model struct {
+	graph    *tensorflow.Graph
+	session  session
+	labelMap map[int]internal.Prediction // read only once loaded
+	ranges   *rangeMap                   // nil without range data, read only
+	seasons  seasonTable                 // nil without a seasonality table, read only
+	version  string
+
+	// temperature calibrates the model's scores, 1 without calibration
+	temperature float32
+
+	// the tensors fed and fetched, resolved from the configured names
+	input   tensorflow.Output
+	scores  tensorflow.Output
+	classes tensorflow.Output
+	num     tensorflow.Output
+	boxes   tensorflow.Output
+
+	// probabilities is the output of classification models instead of the detection outputs
+	probabilities tensorflow.Output
+
+	// inflight counts the predictions using the session, it's only closed once they finish
+	inflight sync.WaitGroup
+}
+
+func (m *model) release() {
+	m.inflight.Done()
+}
+
+// drain waits for in-flight predictions then closes the session
+func (m *model) drain() error {
+	m.inflight.Wait()
+	return m.session.Close()
+}
+
+// resolve finds every tensor predict runs, signature keys take precedence over tensor names, and
+// checks the labels aren't empty
+func (m *model) resolve(modelType string, names TensorNames, signature *signature) error {
+	type tensor struct {
+		output *tensorflow.Output
+		name   string
+		keys   map[string]string
+	}
+	tensors := []tensor{
+		{&m.input, names.Input, signature.inputMap()},
+	}
+	switch modelType {
+	case TypeClassification:
+		tensors = append(tensors, tensor{&m.probabilities, names.Probabilities, signature.outputMap()})
+	case TypeDetection, "":
+		tensors = append(tensors,
+			tensor{&m.scores, names.Scores, signature.outputMap()},
+			tensor{&m.classes, names.Classes, signature.outputMap()},
+			tensor{&m.num, names.NumDetections, signature.outputMap()},
+			tensor{&m.boxes, names.Boxes, signature.outputMap()},
+		)
+	default:
+		return fmt.Errorf("unknown model type %s", modelType)
+	}
+	for _, t := range tensors {
+		output, err := tensorOutput(m.graph, t.name, t.keys)
+		if err != nil {
+			return err
+		}
+		*t.output = output
+	}
+	if len(m.labelMap) == 0 {
+		return errors.New("label map is empty")
+	}
+	return nil
+}
+
+// tensorOutput looks a tensor up by signature key, then by name, "op" is the first output of op
+// and "op:1" the second
+func tensorOutput(graph *tensorflow.Graph, name string, keys map[string]string) (tensorflow.Output, error) {
+	tensor := name
+	if t, ok := keys[name]; ok {
+		tensor = t
+	}
+	op, index := tensor, 0
+	if i := strings.LastIndex(tensor, ":"); i >= 0 {
+		n, err := strconv.Atoi(tensor[i+1:])
+		if err != nil {
+			return tensorflow.Output{}, fmt.Errorf("invalid tensor name %s", tensor)
+		}
+		op, index = tensor[:i], n
+	}
+	operation := graph.Operation(op)
+	if operation == nil || index < 0 || index >= operation.NumOutputs() {
+		return tensorflow.Output{}, fmt.Errorf("model has no tensor %s", tensor)
+	}
+	return operation.Output(index), nil
+}
+
+// Version identifies the model being served, empty until a model has loaded
+func (s *tfService) Version() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == nil {
+		return ""
+	}
+	return s.current.version
+}
+
+// labels is how many labels the current model has
+func (s *tfService) labels() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.current == nil {
+		return 0
+	}
+	return len(s.current.labelMap)
+}
+
+// Reload loads the model and labels next to the current ones and swaps them in once they're valid,
+// the old session is closed after its in-flight predictions finish. If anything fails the current
+// model keeps serving.
+func (s *tfService) Reload() error {
+	return s.reload(nil)
+}
+
+// reload loads a model with the given files, nil reads them from the bucket again
+func (s *tfService) reload(files *model) error {
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	m, err := s.load(files)
+
+	s.mu.Lock()
+	if err == nil && s.closed {
+		err = errors.New("predictor is closed")
+		m.session.Close()
+	}
+	if err != nil {
+		if s.current == nil && !s.closed {
+			s.state = internal.ModelFailed
+		}
+		s.mu.Unlock()
+		return err
+	}
+	old := s.current
+	s.current = m
+	s.state = internal.ModelReady
+	if old != nil {
+		s.draining.Add(1)
+	}
+	s.mu.Unlock()
+
+	logrus.WithField("version", m.version).Info("loaded model")
+	if old != nil {
+		go func() {
+			defer s.draining.Done()
+			if err := old.drain(); err != nil {
+				logrus.WithError(err).WithField("version", old.version).Warn("unable to close previous model")
+				return
+			}
+			logrus.WithField("version", old.version).Info("closed previous model")
+		}()
+	}
+	return nil
+}
+
+// load downloads the model next to its files and checks they can be served, files is nil to read
+// them first
+func (s *tfService) load(files *model) (*model, error) {
+	if files == nil {
+		var err error
+		if files, err = s.loadFiles(); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		graph     *tensorflow.Graph
+		session   *tensorflow.Session
+		signature *signature
+		err       error
+	)
+	switch s.config.Format {
+	case FormatSavedModel:
+		graph, session, signature, err = s.loadSavedModel()
+	case FormatFrozenGraph, "":
+		graph, session, err = s.loadGraphAndSession(s.config.GetModelPath())
+	default:
+		err = fmt.Errorf("unknown model format %s", s.config.Format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load model: %w", err)
+	}
+
+	m := files
+	m.graph = graph
+	m.session = session
+	if err := m.resolve(s.config.Type, s.config.Tensors, signature); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// loadFiles reads everything a model needs besides the graph, the labels, range, seasonality and
+// calibration files, into a model without a session
+func (s *tfService) loadFiles() (*model, error) {
+	// read before downloading so a change made mid download is picked up by the next check
+	version, err := s.version()
+	if err != nil {
+		logrus.WithError(err).Warn("unable to read model version")
+	}
+
+	labelMap, err := s.loadLabelMap(s.config.GetLabelFilePath())
+	if err != nil {
+		return nil, fmt.Errorf("unable to load labels: %w", err)
+	}
+	ranges, err := s.loadRanges()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load range data: %w", err)
+	}
+	seasons, err := s.loadSeasons()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load seasonality table: %w", err)
+	}
+	temperature, err := s.loadCalibration()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load calibration: %w", err)
+	}
+	return &model{
+		labelMap:    labelMap,
+		ranges:      ranges,
+		seasons:     seasons,
+		temperature: temperature,
+		version:     version,
+	}, nil
+}
+
+// version combines the bucket attributes of the model, label, range, seasonality and calibration
+// files, it changes whenever any of them is replaced
+func (s *tfService) version() (string, error) {
+	keys := []string{s.config.GetModelPath(), s.config.GetLabelFilePath()}
+	if s.config.RangeFile != "" {
+		keys = append(keys, s.config.Path+s.config.RangeFile)
+	}
+	if s.config.SeasonFile != "" {
+		keys = append(keys, s.config.Path+s.config.SeasonFile)
+	}
+	if s.config.CalibrationFile != "" {
+		keys = append(keys, s.config.Path+s.config.CalibrationFile)
+	}
+	var parts []string
+	for _, key := range keys {
+		attrs, err := s.bucket.Attributes(context.Background(), key)
+		if err != nil {
+			return "", err
+		}
+		// not every bucket reports an md5, the modification time and size cover those
+		tag := fmt.Sprintf("%x-%d-%d", attrs.MD5, attrs.ModTime.UnixNano(), attrs.Size)
+		parts = append(parts, tag)
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// watch polls the model and label files and reloads when they change, a failed reload is retried
+// on the next tick
+func (s *tfService) watch(interval time.Duration) {
+	logrus.WithField("interval", interval.String()).Info("watching for new models")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		version, err := s.version()
+		if err != nil {
+			logrus.WithError(err).Warn("unable to check for a new model")
+			continue
+		}
+		if version == s.Version() {
+			continue
+		}
+		logrus.WithField("version", version).Info("new model found, reloading")
+		if err := s.Reload(); err != nil {
+			logrus.WithError(err).Error("unable to reload model, keeping the current one")
+		}
+	}
+}
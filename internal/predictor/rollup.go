@@ -0,0 +1,76 @@
+package predictor
+
+import (
+	"nature-id-api/internal"
+	"strings"
+)
+
+// rollup sums probabilities per taxon from species up to the requested rank and returns the
+// narrowest taxon passing the threshold. Detections can find the same label in several boxes so
+// only its best score counts, and sums are capped at 100.
+func rollup(labels internal.Predictions, rank string, threshold float32) *internal.Rollup {
+	best := make(map[int]*internal.Prediction)
+	for _, l := range labels {
+		if l.Taxonomy == nil {
+			continue
+		}
+		if b, ok := best[l.ID]; !ok || l.Score() > b.Score() {
+			best[l.ID] = l
+		}
+	}
+	if len(best) == 0 {
+		return nil
+	}
+
+	var result *internal.Rollup
+	for r := len(internal.Ranks) - 1; r >= internal.RankIndex(rank); r-- {
+		current := internal.Ranks[r]
+		// keyed by lineage, species epithets and some genus names repeat in different families
+		sums := make(map[string]float32)
+		taxa := make(map[string]*internal.Taxonomy)
+		for _, l := range best {
+			if l.Taxonomy.At(current) == "" {
+				continue
+			}
+			key := lineage(l.Taxonomy, current)
+			sums[key] += l.Score()
+			taxa[key] = l.Taxonomy
+		}
+
+		var top string
+		for key, sum := range sums {
+			// ties go to the first lineage alphabetically so responses are stable
+			if top == "" || sum > sums[top] || (sum == sums[top] && key < top) {
+				top = key
+			}
+		}
+		if top == "" {
+			continue
+		}
+		probability := sums[top]
+		if probability > 100 {
+			probability = 100
+		}
+		result = &internal.Rollup{
+			Rank:        current,
+			Name:        taxa[top].At(current),
+			Probability: probability,
+			Threshold:   threshold,
+			Confident:   probability >= threshold,
+			Taxonomy:    taxa[top].Above(current),
+		}
+		if result.Confident {
+			return result
+		}
+	}
+	return result
+}
+
+// lineage joins the taxa from kingdom down to rank
+func lineage(t *internal.Taxonomy, rank string) string {
+	var parts []string
+	for _, r := range internal.Ranks[:internal.RankIndex(rank)+1] {
+		parts = append(parts, t.At(r))
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,49 @@
+package predictor
+
+import (
+	"nature-id-api/internal"
+	"testing"
+)
+
+func taxon(kingdom, family, genus, species string) *internal.Taxonomy {
+	return &internal.Taxonomy{Kingdom: kingdom, Family: family, Genus: genus, Species: species}
+}
+
+// TestRollupCollidingEpithets checks taxa sharing a name at a rank are summed apart when their
+// lineages differ
+func TestRollupCollidingEpithets(t *testing.T) {
+	labels := internal.Predictions{
+		{ID: 1, Name: "Sturnus vulgaris", Probability: 40, Taxonomy: taxon("Animalia", "Sturnidae", "Sturnus", "vulgaris")},
+		{ID: 2, Name: "Thymus vulgaris", Probability: 35, Taxonomy: taxon("Plantae", "Lamiaceae", "Thymus", "vulgaris")},
+		{ID: 3, Name: "Sturnus unicolor", Probability: 25, Taxonomy: taxon("Animalia", "Sturnidae", "Sturnus", "unicolor")},
+	}
+	tests := []struct {
+		rank        string
+		threshold   float32
+		wantRank    string
+		wantName    string
+		probability float32
+		confident   bool
+	}{
+		// the two vulgaris would sum to 75 if keyed by epithet
+		{"species", 60, "species", "vulgaris", 40, false},
+		{"genus", 60, "genus", "Sturnus", 65, true},
+		{"genus", 70, "genus", "Sturnus", 65, false},
+		{"kingdom", 70, "kingdom", "Animalia", 65, false},
+		{"kingdom", 30, "species", "vulgaris", 40, true},
+	}
+	for _, tt := range tests {
+		got := rollup(labels, tt.rank, tt.threshold)
+		if got == nil {
+			t.Errorf("%s at %v: no rollup", tt.rank, tt.threshold)
+			continue
+		}
+		if got.Rank != tt.wantRank || got.Name != tt.wantName || got.Probability != tt.probability || got.Confident != tt.confident {
+			t.Errorf("%s at %v: got %s %s %v confident %v, want %s %s %v confident %v", tt.rank, tt.threshold,
+				got.Rank, got.Name, got.Probability, got.Confident, tt.wantRank, tt.wantName, tt.probability, tt.confident)
+		}
+		if tt.wantName == "vulgaris" && got.Taxonomy.Genus != "Sturnus" {
+			t.Errorf("%s at %v: vulgaris rolled up under %s", tt.rank, tt.threshold, got.Taxonomy.Genus)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package predictor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"nature-id-api/internal"
+	"sync"
+	"time"
+)
+
+type RouteConfig struct {
+	// Candidate is the registered model compared with the default one, empty disables routing
+	Candidate string
+	Mode      internal.RouteMode
+	// Percent of requests sent to, or shadowed by, the candidate
+	Percent float64
+	// ShadowConcurrency caps how many shadow predictions run at once, more are dropped
+	ShadowConcurrency int
+}
+
+func LoadRouteConfig() RouteConfig {
+	return RouteConfig{
+		Candidate:         GetEnv("ROUTE_CANDIDATE", ""),
+		Mode:              internal.RouteMode(GetEnv("ROUTE_MODE", string(internal.RouteShadow))),
+		Percent:           float64(getEnvFloat("ROUTE_PERCENT", 10)),
+		ShadowConcurrency: getEnvInt("ROUTE_SHADOW_CONCURRENCY", 2),
+	}
+}
+
+// routedPredictor sends a share of traffic to a candidate model, either answering with it or running
+// it in the background to compare its top prediction with the primary's
+type routedPredictor struct {
+	primary   internal.MonitoredPredictor
+	candidate internal.MonitoredPredictor
+	names     [2]string
+	config    RouteConfig
+	shadows   chan struct{}
+	running   sync.WaitGroup
+
+	mu     sync.Mutex
+	random *rand.Rand
+	stats  internal.RoutingStats
+}
+
+// NewRoutedPredictor routes between two models, stats and state are reported from the primary
+func NewRoutedPredictor(primary, candidate internal.MonitoredPredictor, primaryName, candidateName string, config RouteConfig) (internal.MonitoredPredictor, error) {
+	if config.Mode != internal.RouteSplit && config.Mode != internal.RouteShadow {
+		return nil, fmt.Errorf("unknown route mode %s, expected split or shadow", config.Mode)
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return nil, fmt.Errorf("route percent must be between 0 and 100, got %v", config.Percent)
+	}
+	concurrency := config.ShadowConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &routedPredictor{
+		primary:   primary,
+		candidate: candidate,
+		names:     [2]string{primaryName, candidateName},
+		config:    config,
+		shadows:   make(chan struct{}, concurrency),
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// sample reports whether this request goes to the candidate
+func (r *routedPredictor) sample() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.random.Float64()*100 < r.config.Percent
+}
+
+func (r *routedPredictor) count(candidate bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if candidate {
+		r.stats.CandidateRequests++
+	} else {
+		r.stats.PrimaryRequests++
+	}
+}
+
+func (r *routedPredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	sampled := r.sample()
+	if r.config.Mode == internal.RouteSplit {
+		r.count(sampled)
+		if sampled {
+			return r.candidate.Predict(img, opts)
+		}
+		return r.primary.Predict(img, opts)
+	}
+
+	r.count(false)
+	if !sampled {
+		return r.primary.Predict(img, opts)
+	}
+	// both models need the upload
+	data, err := ioutil.ReadAll(img)
+	if err != nil {
+		return internal.Result{}, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+	}
+	result, err := r.primary.Predict(bytes.NewReader(data), opts)
+	if err != nil {
+		return internal.Result{}, err
+	}
+	r.shadow(func() {
+		shadowed, err := r.candidate.Predict(bytes.NewReader(data), opts)
+		r.compare(result.Top, shadowed.Top, err)
+	})
+	return result, nil
+}
+
+func (r *routedPredictor) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+	sampled := r.sample()
+	if r.config.Mode == internal.RouteSplit {
+		r.count(sampled)
+		if sampled {
+			return r.candidate.PredictBatch(imgs, opts)
+		}
+		return r.primary.PredictBatch(imgs, opts)
+	}
+
+	r.count(false)
+	if !sampled {
+		return r.primary.PredictBatch(imgs, opts)
+	}
+	data := make([][]byte, len(imgs))
+	for i, img := range imgs {
+		b, err := ioutil.ReadAll(img.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", internal.ErrInvalidImage, err)
+		}
+		data[i] = b
+		imgs[i].Body = bytes.NewReader(b)
+	}
+	results, err := r.primary.PredictBatch(imgs, opts)
+	if err != nil {
+		return nil, err
+	}
+	r.shadow(func() {
+		copies := make([]internal.Image, len(imgs))
+		for i, img := range imgs {
+			copies[i] = internal.Image{Name: img.Name, Body: bytes.NewReader(data[i])}
+		}
+		shadowed, err := r.candidate.PredictBatch(copies, opts)
+		for name, result := range results {
+			if result.Error != "" {
+				continue
+			}
+			if err == nil && shadowed[name].Error != "" {
+				r.compare(result.Top, nil, errors.New(shadowed[name].Error))
+				continue
+			}
+			r.compare(result.Top, shadowed[name].Top, err)
+		}
+	})
+	return results, nil
+}
+
+// shadow runs a candidate prediction in the background unless too many are already running
+func (r *routedPredictor) shadow(run func()) {
+	select {
+	case r.shadows <- struct{}{}:
+	default:
+		r.mu.Lock()
+		r.stats.Dropped++
+		r.mu.Unlock()
+		return
+	}
+	r.running.Add(1)
+	go func() {
+		defer func() {
+			<-r.shadows
+			r.running.Done()
+		}()
+		run()
+	}()
+}
+
+// compare records whether the candidate's top prediction matches the primary's, labels are matched
+// by name so retrained models with renumbered ids still compare. The tops are the raw model outputs,
+// the request's filters and priors don't decide agreement
+func (r *routedPredictor) compare(primary, candidate *internal.Prediction, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Shadowed++
+	if err != nil {
+		r.stats.ShadowErrors++
+		logrus.WithError(err).WithField("candidate", r.names[1]).Warn("shadow prediction failed")
+		return
+	}
+
+	expected, actual := topName(primary), topName(candidate)
+	agreed := expected == actual
+	if agreed {
+		r.stats.Agreed++
+	} else {
+		r.stats.Disagreed++
+	}
+	logrus.WithFields(logrus.Fields{
+		"primary":       r.names[0],
+		"candidate":     r.names[1],
+		"primary_top":   expected,
+		"candidate_top": actual,
+		"agreed":        agreed,
+	}).Info("shadow prediction")
+}
+
+// topName is empty when nothing was found
+func topName(top *internal.Prediction) string {
+	if top == nil {
+		return ""
+	}
+	return top.Name
+}
+
+func (r *routedPredictor) RoutingStats() internal.RoutingStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Primary = r.names[0]
+	stats.Candidate = r.names[1]
+	stats.Mode = r.config.Mode
+	stats.Percent = r.config.Percent
+	if compared := stats.Agreed + stats.Disagreed; compared > 0 {
+		stats.Agreement = float64(stats.Agreed) / float64(compared)
+	}
+	return stats
+}
+
+func (r *routedPredictor) Stats() internal.InferenceStats {
+	return r.primary.Stats()
+}
+
+func (r *routedPredictor) State() internal.ModelState {
+	return r.primary.State()
+}
+
+// Close waits for shadow predictions to finish, the models themselves are closed by their registry
+func (r *routedPredictor) Close() error {
+	r.running.Wait()
+	return nil
+}
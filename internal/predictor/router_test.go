@@ -0,0 +1,83 @@
+package predictor
+
+import (
+	"bytes"
+	"io"
+	"nature-id-api/internal"
+	"testing"
+)
+
+// resultPredictor always answers with the same result
+type resultPredictor struct {
+	result internal.Result
+}
+
+func (p resultPredictor) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+	return p.result, nil
+}
+
+func (p resultPredictor) PredictBatch(imgs []internal.Image, opts internal.PredictOptions) (map[string]internal.BatchResult, error) {
+	results := make(map[string]internal.BatchResult, len(imgs))
+	for _, img := range imgs {
+		results[img.Name] = internal.BatchResult{Predictions: p.result.Predictions, Top: p.result.Top}
+	}
+	return results, nil
+}
+
+func (p resultPredictor) State() internal.ModelState {
+	return internal.ModelReady
+}
+
+func (p resultPredictor) Stats() internal.InferenceStats {
+	return internal.InferenceStats{}
+}
+
+func (p resultPredictor) Close() error {
+	return nil
+}
+
+// TestShadowComparesModelOutputs checks agreement is decided by the models' own top predictions,
+// not what is left once the request's filters have run
+func TestShadowComparesModelOutputs(t *testing.T) {
+	robin := &internal.Prediction{ID: 1, Name: "robin", Probability: 40}
+	wren := &internal.Prediction{ID: 7, Name: "wren", Probability: 40}
+	tests := []struct {
+		name               string
+		primary, candidate internal.Result
+		agreed             bool
+	}{
+		// min_probability filtered everything out of both responses
+		{"both filtered", internal.Result{Top: robin}, internal.Result{Top: robin}, true},
+		{"one filtered", internal.Result{Predictions: internal.Predictions{robin}, Top: robin}, internal.Result{Top: robin}, true},
+		{"filtered but different", internal.Result{Top: robin}, internal.Result{Top: wren}, false},
+		// the filtered top differs from the model's, an include list or a prior reordered them
+		{"filters reordered", internal.Result{Predictions: internal.Predictions{wren}, Top: robin}, internal.Result{Predictions: internal.Predictions{robin}, Top: robin}, true},
+		{"nothing found", internal.Result{}, internal.Result{}, true},
+	}
+	for _, tt := range tests {
+		routed, err := NewRoutedPredictor(resultPredictor{tt.primary}, resultPredictor{tt.candidate}, "primary", "candidate", RouteConfig{
+			Mode:              internal.RouteShadow,
+			Percent:           100,
+			ShadowConcurrency: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := routed.Predict(bytes.NewReader([]byte("img")), internal.PredictOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := routed.PredictBatch(images(1), internal.PredictOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		routed.Close()
+
+		stats := routed.(internal.RoutingMonitor).RoutingStats()
+		if stats.Shadowed != 2 {
+			t.Errorf("%s: %d shadowed, want 2", tt.name, stats.Shadowed)
+			continue
+		}
+		if agreed := stats.Agreed == 2; agreed != tt.agreed {
+			t.Errorf("%s: agreed %d of 2, want agreement %v", tt.name, stats.Agreed, tt.agreed)
+		}
+	}
+}
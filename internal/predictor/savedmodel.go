@@ -0,0 +1,254 @@
+package predictor
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"gocloud.dev/blob"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// signature maps a SavedModel signature's input and output keys to tensor names
+type signature struct {
+	inputs  map[string]string
+	outputs map[string]string
+}
+
+// inputMap is nil safe, frozen graphs have no signature
+func (s *signature) inputMap() map[string]string {
+	if s == nil {
+		return nil
+	}
+	return s.inputs
+}
+
+func (s *signature) outputMap() map[string]string {
+	if s == nil {
+		return nil
+	}
+	return s.outputs
+}
+
+// loadSavedModel downloads saved_model.pb and the variables to a temporary directory, the variables
+// are restored into the session so the directory is removed once loaded. Through an ArtifactStore the
+// variables are checked against the manifest in variables/ like any other artifact
+func (s *tfService) loadSavedModel() (*tensorflow.Graph, *tensorflow.Session, *signature, error) {
+	ctx := context.Background()
+	logrus.WithField("path", s.config.Path).Info("downloading saved model")
+
+	dir, err := ioutil.TempDir("", "saved_model")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	pb, err := s.bucket.ReadAll(ctx, s.config.GetModelPath())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "saved_model.pb"), pb, 0644); err != nil {
+		return nil, nil, nil, err
+	}
+
+	variables, err := s.variableKeys(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := os.Mkdir(filepath.Join(dir, "variables"), 0755); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, key := range variables {
+		data, err := s.bucket.ReadAll(ctx, key)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("unable to read variables: %w", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "variables", path.Base(key)), data, 0644); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	logrus.WithField("variables", len(variables)).Info("downloaded saved model")
+
+	sig, err := readSignature(pb, s.config.Tags, s.config.Signature)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	saved, err := tensorflow.LoadSavedModel(dir, s.config.Tags, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	logrus.WithFields(logrus.Fields{"tags": s.config.Tags, "signature": s.config.Signature}).Info("model created")
+	return saved.Graph, saved.Session, sig, nil
+}
+
+// variableKeys lists the checkpoint files under variables/, anything else there such as a manifest
+// is skipped
+func (s *tfService) variableKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	iter := s.bucket.List(&blob.ListOptions{Prefix: s.config.Path + "variables/"})
+	for {
+		obj, err := iter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list variables: %w", err)
+		}
+		if !obj.IsDir && strings.HasPrefix(path.Base(obj.Key), "variables.") {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return keys, nil
+}
+
+// readSignature finds the named signature in the meta graph with exactly the given tags, the
+// SavedModel proto is walked by field number to avoid generating tensorflow's protos
+func readSignature(pb []byte, tags []string, name string) (*signature, error) {
+	var found *signature
+	metaGraphs := 0
+	err := walkMessage(pb, func(num protowire.Number, metaGraph []byte) error {
+		// SavedModel.meta_graphs
+		if num != 2 || found != nil {
+			return nil
+		}
+		metaGraphs++
+		var graphTags []string
+		signatures := make(map[string][]byte)
+		err := walkMessage(metaGraph, func(num protowire.Number, value []byte) error {
+			switch num {
+			case 1: // MetaGraphDef.meta_info_def
+				return walkMessage(value, func(num protowire.Number, tag []byte) error {
+					if num == 4 { // MetaInfoDef.tags
+						graphTags = append(graphTags, string(tag))
+					}
+					return nil
+				})
+			case 5: // MetaGraphDef.signature_def
+				key, sig, err := mapEntry(value)
+				if err != nil {
+					return err
+				}
+				signatures[key] = sig
+			}
+			return nil
+		})
+		if err != nil || !sameTags(graphTags, tags) {
+			return err
+		}
+		def, ok := signatures[name]
+		if !ok {
+			var names []string
+			for n := range signatures {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("saved model has no signature %s, found %v", name, names)
+		}
+		found, err = parseSignature(def)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read saved model signature: %w", err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("none of the %d meta graphs in the saved model are tagged %v", metaGraphs, tags)
+	}
+	return found, nil
+}
+
+// parseSignature reads a SignatureDef's input and output maps of key to TensorInfo.name
+func parseSignature(def []byte) (*signature, error) {
+	sig := &signature{inputs: make(map[string]string), outputs: make(map[string]string)}
+	err := walkMessage(def, func(num protowire.Number, value []byte) error {
+		if num != 1 && num != 2 {
+			return nil
+		}
+		key, info, err := mapEntry(value)
+		if err != nil {
+			return err
+		}
+		var tensor string
+		err = walkMessage(info, func(num protowire.Number, value []byte) error {
+			if num == 1 { // TensorInfo.name
+				tensor = string(value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if num == 1 {
+			sig.inputs[key] = tensor
+		} else {
+			sig.outputs[key] = tensor
+		}
+		return nil
+	})
+	return sig, err
+}
+
+// mapEntry reads a proto map entry, the key is field 1 and the value field 2
+func mapEntry(entry []byte) (key string, value []byte, err error) {
+	err = walkMessage(entry, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 1:
+			key = string(v)
+		case 2:
+			value = v
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+// walkMessage calls fn with every length delimited field of a proto message, strings and embedded
+// messages, other fields are skipped
+func walkMessage(b []byte, fn func(num protowire.Number, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameTags matches meta graph tags the way tensorflow does, as a set
+func sameTags(a, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, t := range a {
+		set[t] = true
+	}
+	other := make(map[string]bool, len(b))
+	for _, t := range b {
+		if !set[t] {
+			return false
+		}
+		other[t] = true
+	}
+	return len(set) == len(other)
+}
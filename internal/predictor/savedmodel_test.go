@@ -0,0 +1,38 @@
+package predictor
+
+import (
+	"context"
+	"errors"
+	"nature-id-api/internal/storage"
+	"testing"
+)
+
+// TestSavedModelVariablesVerified checks variables without their own manifest are refused like any
+// other artifact when manifests are required, even when saved_model.pb is verified
+func TestSavedModelVariablesVerified(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := storage.NewBucketStorage(storage.BucketConfig{ConnectionString: "mem://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	// sha256 of "pb"
+	files := map[string]string{
+		"model/saved_model.pb":            "pb",
+		"model/SHA256SUMS":                "3315f44da4a7aaaf8d84382c7583233f697787f5871294ed49cd41207f7375a0  saved_model.pb\n",
+		"model/variables/variables.index": "index",
+	}
+	for key, data := range files {
+		if err := bucket.WriteAll(ctx, key, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &tfService{
+		bucket: storage.NewArtifactStore(bucket, storage.ArtifactConfig{Manifest: "SHA256SUMS", RequireManifest: true}),
+		config: ModelConfig{Path: "model/", Name: "saved_model.pb", Format: FormatSavedModel},
+	}
+	if _, _, _, err := s.loadSavedModel(); !errors.Is(err, storage.ErrUnverified) {
+		t.Errorf("got %v, want %v", err, storage.ErrUnverified)
+	}
+}
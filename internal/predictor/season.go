@@ -0,0 +1,95 @@
+package predictor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"nature-id-api/internal"
+	"strconv"
+	"time"
+)
+
+// seasonFile is the per-label seasonality table, twelve values from January to December giving how
+// often the label is recorded that month relative to its busiest month
+//
+//	{"labels": {"12": [0, 0, 0.1, 0.6, 1, 1, 0.9, 0.8, 0.5, 0.1, 0, 0]}}
+type seasonFile struct {
+	Labels map[string][]float32 `json:"labels"`
+}
+
+// seasonTable holds each label's monthly occurrence, labels missing from it are never adjusted
+type seasonTable map[int][12]float32
+
+func parseSeasons(data []byte) (seasonTable, error) {
+	var f seasonFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	table := make(seasonTable, len(f.Labels))
+	for key, months := range f.Labels {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label id %q", key)
+		}
+		if len(months) != 12 {
+			return nil, fmt.Errorf("label %d has %d months, expected 12", id, len(months))
+		}
+		var occurrence [12]float32
+		for i, v := range months {
+			if v < 0 || v > 1 {
+				return nil, fmt.Errorf("label %d has %v for %s, expected between 0 and 1", id, v, time.Month(i+1))
+			}
+			occurrence[i] = v
+		}
+		table[id] = occurrence
+	}
+	return table, nil
+}
+
+// loadSeasons reads the seasonality table next to the model, nil when none is configured
+func (s *tfService) loadSeasons() (seasonTable, error) {
+	if s.config.SeasonFile == "" {
+		return nil, nil
+	}
+	path := s.config.Path + s.config.SeasonFile
+	logrus.WithField("path", path).Info("downloading seasonality table")
+	data, err := s.bucket.ReadAll(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSeasons(data)
+}
+
+// adjustForSeason scales labels by how often they're recorded in the month the photo was taken,
+// never by less than SeasonMinFactor, the request's date wins over the photo's EXIF date
+func (s *tfService) adjustForSeason(m *model, labels internal.Predictions, meta metadata, opts internal.PredictOptions) {
+	if m.seasons == nil || opts.NoSeason {
+		return
+	}
+	date, source := opts.Date, "request"
+	if date == nil {
+		date, source = meta.taken, "photo exif"
+	}
+	if date == nil {
+		return
+	}
+
+	month := date.Month()
+	for _, l := range labels {
+		occurrence, ok := m.seasons[l.ID]
+		if !ok {
+			continue
+		}
+		factor := occurrence[month-1]
+		if factor < s.config.SeasonMinFactor {
+			factor = s.config.SeasonMinFactor
+		}
+		l.Adjust(internal.Adjustment{
+			Source: "season",
+			Factor: factor,
+			Reason: fmt.Sprintf("recorded in %s at %.0f%% of its peak month, date %s from the %s",
+				month, occurrence[month-1]*100, date.Format("2006-01-02"), source),
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package predictor
+
+import (
+	"nature-id-api/internal"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSeasons(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"labels": {"1": [0, 0.02, 0.1, 0.6, 1, 1, 0.9, 0.8, 0.5, 0.1, 0, 0]}}`, false},
+		{"empty", `{"labels": {}}`, false},
+		{"eleven months", `{"labels": {"1": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}}`, true},
+		{"thirteen months", `{"labels": {"1": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}}`, true},
+		{"negative", `{"labels": {"1": [0, -0.1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}}`, true},
+		{"above one", `{"labels": {"1": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1.5]}}`, true},
+		{"label id", `{"labels": {"robin": [0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]}}`, true},
+		{"json", `{"labels": [`, true},
+	}
+	for _, tt := range tests {
+		if _, err := parseSeasons([]byte(tt.data)); (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseSeasons returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	table, err := parseSeasons([]byte(`{"labels": {"7": [0, 0.02, 0.1, 0.6, 1, 1, 0.9, 0.8, 0.5, 0.1, 0, 0]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table[7][time.April-1] != 0.6 || table[7][time.December-1] != 0 {
+		t.Errorf("months are out of place: %v", table[7])
+	}
+}
+
+func TestAdjustForSeason(t *testing.T) {
+	seasons, err := parseSeasons([]byte(`{"labels": {"1": [0, 0.02, 0.1, 0.6, 1, 1, 0.9, 0.8, 0.5, 0.1, 0, 0]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &model{seasons: seasons}
+	s := &tfService{config: ModelConfig{SeasonMinFactor: 0.05}}
+	date := func(month time.Month) *time.Time {
+		d := time.Date(2020, month, 15, 12, 0, 0, 0, time.UTC)
+		return &d
+	}
+
+	tests := []struct {
+		name   string
+		taken  *time.Time
+		opts   internal.PredictOptions
+		want   float32 // adjusted probability of label 1, 0 when it's left alone
+		source string
+	}{
+		{"peak month", date(time.June), internal.PredictOptions{}, 0, ""},
+		{"april", date(time.April), internal.PredictOptions{}, 30, "photo exif"},
+		{"floored at zero", date(time.January), internal.PredictOptions{}, 2.5, "photo exif"},
+		{"floored below min", date(time.February), internal.PredictOptions{}, 2.5, "photo exif"},
+		{"request date wins", date(time.June), internal.PredictOptions{Date: date(time.April)}, 30, "request"},
+		{"request date without exif", nil, internal.PredictOptions{Date: date(time.March)}, 5, "request"},
+		{"request peak over exif", date(time.January), internal.PredictOptions{Date: date(time.May)}, 0, ""},
+		{"season=false", date(time.January), internal.PredictOptions{NoSeason: true}, 0, ""},
+		{"no date", nil, internal.PredictOptions{}, 0, ""},
+	}
+	for _, tt := range tests {
+		labels := internal.Predictions{{ID: 1, Probability: 50}, {ID: 2, Probability: 50}}
+		s.adjustForSeason(m, labels, metadata{taken: tt.taken}, tt.opts)
+
+		if labels[1].AdjustedProbability != nil {
+			t.Errorf("%s: label without seasonality was adjusted: %+v", tt.name, labels[1])
+		}
+		got := labels[0]
+		if tt.want == 0 {
+			if got.AdjustedProbability != nil {
+				t.Errorf("%s: adjusted to %v, want no adjustment", tt.name, *got.AdjustedProbability)
+			}
+			continue
+		}
+		if got.AdjustedProbability == nil || len(got.Adjustments) != 1 {
+			t.Errorf("%s: not adjusted, want %v", tt.name, tt.want)
+			continue
+		}
+		if diff := *got.AdjustedProbability - tt.want; diff > 1e-4 || diff < -1e-4 {
+			t.Errorf("%s: adjusted to %v, want %v", tt.name, *got.AdjustedProbability, tt.want)
+		}
+		if !strings.Contains(got.Adjustments[0].Reason, tt.source) {
+			t.Errorf("%s: reason %q doesn't name the %s date", tt.name, got.Adjustments[0].Reason, tt.source)
+		}
+	}
+
+	// without a table nothing is adjusted
+	labels := internal.Predictions{{ID: 1, Probability: 50}}
+	s.adjustForSeason(&model{}, labels, metadata{taken: date(time.January)}, internal.PredictOptions{})
+	if labels[0].AdjustedProbability != nil {
+		t.Errorf("adjusted without a seasonality table: %+v", labels[0])
+	}
+}
@@ -1,18 +1,19 @@
 package predictor
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/tensorflow/tensorflow/tensorflow/go"
-	"github.com/tensorflow/tensorflow/tensorflow/go/op"
 	"gocloud.dev/blob"
 	"io"
-	"log"
 	"nature-id-api/internal"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,17 +25,205 @@ func GetEnv(env, fallback string) string {
 	return e
 }
 
+func getEnvInt(env string, fallback int) int {
+	e, err := strconv.Atoi(os.Getenv(env))
+	if err != nil {
+		return fallback
+	}
+	return e
+}
+
+func getEnvFloat(env string, fallback float32) float32 {
+	e, err := strconv.ParseFloat(os.Getenv(env), 32)
+	if err != nil {
+		return fallback
+	}
+	return float32(e)
+}
+
+func getEnvBool(env string, fallback bool) bool {
+	e, err := strconv.ParseBool(os.Getenv(env))
+	if err != nil {
+		return fallback
+	}
+	return e
+}
+
+// getEnvChannels reads one value for every channel or three comma separated values, one per channel
+func getEnvChannels(env string, fallback float32) [3]float32 {
+	channels := [3]float32{fallback, fallback, fallback}
+	parts := strings.Split(os.Getenv(env), ",")
+	if len(parts) != 1 && len(parts) != 3 {
+		return channels
+	}
+	for i := range channels {
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[i%len(parts)]), 32)
+		if err != nil {
+			return [3]float32{fallback, fallback, fallback}
+		}
+		channels[i] = float32(v)
+	}
+	return channels
+}
+
+// Model formats, a frozen GraphDef or a SavedModel directory
+const (
+	FormatFrozenGraph = "frozen"
+	FormatSavedModel  = "saved_model"
+)
+
+// Model types, object detection returns boxes while classification scores the whole image
+const (
+	TypeDetection      = "detection"
+	TypeClassification = "classification"
+)
+
 type ModelConfig struct {
 	Path string
 	Name string
 	LabelFile string
+	// LabelFormat is json or pbtxt, empty picks by the label file's extension
+	LabelFormat string
+	// Format is frozen for a GraphDef at Path+Name or saved_model for a SavedModel directory at Path,
+	// a SavedModel's graph is picked by Tags and its tensors by the Signature
+	Format string
+	Tags []string
+	Signature string
+	Tensors TensorNames
+	// Type is detection or classification, classification models are fed Input sized images and
+	// return at most their TopK classes after adjustment and filtering, class i is label i+LabelOffset
+	Type string
+	Input InputConfig
+	TopK int
+	LabelOffset int
+	// Logits is set when the classification output isn't a softmax yet
+	Logits bool
+	// MaxDimension caps the longest side of an image before inference, 0 disables resizing
+	MaxDimension int
+	// MaxPixels refuses images whose header declares more pixels before they're decoded, 0 allows any
+	MaxPixels int
+	// MinProbability and Limit are used when a request doesn't set its own, 0 keeps everything
+	MinProbability float32
+	Limit int
+	// RollupThreshold is the summed probability a taxon needs when a request doesn't set its own
+	RollupThreshold float32
+	// RangeFile is the gridded range data next to the model, labels not recorded within RangeNeighbors
+	// cells of the photo have their probability scaled by RangeAbsentFactor, empty disables it
+	RangeFile string
+	RangeNeighbors int
+	RangeAbsentFactor float32
+	// SeasonFile is the monthly occurrence table next to the model, labels are scaled by their
+	// occurrence in the month the photo was taken but never below SeasonMinFactor, empty disables it
+	SeasonFile      string
+	SeasonMinFactor float32
+	// CalibrationFile holds the temperature scores are calibrated with, empty leaves them as they are
+	CalibrationFile string
+	// Reject is the rule deciding a photo shows nothing the model knows, max_probability when the top
+	// calibrated probability is below RejectMinProbability or entropy when the normalized entropy of
+	// the class probabilities is above RejectMaxEntropy, empty never rejects
+	Reject               string
+	RejectMinProbability float32
+	RejectMaxEntropy     float32
+	// BatchSize is how many same sized images are run through the model at once, 1 disables batching
+	BatchSize int
+	// Workers is how many predictions run at once, up to QueueSize more wait at most QueueTimeout
+	Workers int
+	QueueSize int
+	QueueTimeout time.Duration
+	// WatchInterval is how often the model and label files are checked for a new version, 0 disables watching
+	WatchInterval time.Duration
 }
-func LoadModelConfig() ModelConfig {
-	return ModelConfig{
-		Path: GetEnv("MODEL_PATH", "models/faster_rcnn_resnet50_fgvc_2018_07_19/"),
-		Name: GetEnv("MODEL_NAME", "model.pb"),
-		LabelFile: GetEnv("MODEL_PATH", "labels.json"),
+
+// loadModelConfig reads the config of a named model from MODEL_<NAME>_ variables, anything not set
+// for the model falls back to the shared MODEL_ variable. A rejection rule the model can't use is
+// an error
+func loadModelConfig(name string) (ModelConfig, error) {
+	env := func(key string) string {
+		return modelEnv(name, key)
 	}
+	format := GetEnv(env("FORMAT"), FormatFrozenGraph)
+	file := "model.pb"
+	if format == FormatSavedModel {
+		file = "saved_model.pb"
+	}
+	config := ModelConfig{
+		Path: GetEnv(env("PATH"), "models/faster_rcnn_resnet50_fgvc_2018_07_19/"),
+		Name: GetEnv(env("NAME"), file),
+		LabelFile: GetEnv(env("LABEL_FILE"), "labels.json"),
+		LabelFormat: GetEnv(env("LABEL_FORMAT"), ""),
+		Format: format,
+		Tags: strings.Split(GetEnv(env("TAGS"), "serve"), ","),
+		Signature: GetEnv(env("SIGNATURE"), "serving_default"),
+		Tensors: TensorNames{
+			Input: GetEnv(env("INPUT_TENSOR"), "image_tensor"),
+			Scores: GetEnv(env("SCORES_TENSOR"), "detection_scores"),
+			Classes: GetEnv(env("CLASSES_TENSOR"), "detection_classes"),
+			NumDetections: GetEnv(env("NUM_DETECTIONS_TENSOR"), "num_detections"),
+			Boxes: GetEnv(env("BOXES_TENSOR"), "detection_boxes"),
+			Probabilities: GetEnv(env("PROBABILITIES_TENSOR"), "probabilities"),
+		},
+		Type: GetEnv(env("TYPE"), TypeDetection),
+		Input: InputConfig{
+			Width: getEnvInt(env("INPUT_WIDTH"), 224),
+			Height: getEnvInt(env("INPUT_HEIGHT"), 224),
+			Float: getEnvBool(env("INPUT_FLOAT"), true),
+			// scales pixels to [0, 1] by default
+			Mean: getEnvChannels(env("INPUT_MEAN"), 0),
+			Std: getEnvChannels(env("INPUT_STD"), 255),
+		},
+		TopK: getEnvInt(env("TOP_K"), 5),
+		LabelOffset: getEnvInt(env("LABEL_OFFSET"), 0),
+		Logits: getEnvBool(env("OUTPUT_LOGITS"), false),
+		// the fgvc model resizes to at most 1024 internally so anything larger is wasted memory
+		MaxDimension: getEnvInt(env("MAX_DIMENSION"), 1024),
+		// enough for 48 megapixel cameras, decoded that's already 150MB of RGB
+		MaxPixels: getEnvInt(env("MAX_PIXELS"), 50000000),
+		MinProbability: getEnvFloat(env("MIN_PROBABILITY"), 1),
+		Limit: getEnvInt(env("LIMIT"), 0),
+		RollupThreshold: getEnvFloat(env("ROLLUP_THRESHOLD"), 80),
+		RangeFile: GetEnv(env("RANGE_FILE"), ""),
+		RangeNeighbors: getEnvInt(env("RANGE_NEIGHBORS"), 1),
+		RangeAbsentFactor: getEnvFloat(env("RANGE_ABSENT_FACTOR"), 0.1),
+		SeasonFile: GetEnv(env("SEASON_FILE"), ""),
+		SeasonMinFactor: getEnvFloat(env("SEASON_MIN_FACTOR"), 0.05),
+		CalibrationFile: GetEnv(env("CALIBRATION_FILE"), ""),
+		Reject: GetEnv(env("REJECT"), ""),
+		RejectMinProbability: getEnvFloat(env("REJECT_MIN_PROBABILITY"), 50),
+		RejectMaxEntropy: getEnvFloat(env("REJECT_MAX_ENTROPY"), 0.8),
+		BatchSize: getEnvInt(env("BATCH_SIZE"), 1),
+		Workers: getEnvInt(env("WORKERS"), 2),
+		QueueSize: getEnvInt(env("QUEUE_SIZE"), 8),
+		QueueTimeout: time.Duration(getEnvInt(env("QUEUE_TIMEOUT_MS"), 30000)) * time.Millisecond,
+		WatchInterval: time.Duration(getEnvInt(env("WATCH_INTERVAL_SECONDS"), 0)) * time.Second,
+	}
+	if err := checkReject(config.Reject, config.Type); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// modelEnv returns MODEL_<NAME>_<KEY> when it's set for the named model, otherwise MODEL_<KEY>
+func modelEnv(name, key string) string {
+	if name != "" {
+		prefixed := "MODEL_" + envName(name) + "_" + key
+		if os.Getenv(prefixed) != "" {
+			return prefixed
+		}
+	}
+	return "MODEL_" + key
+}
+
+// envName upper cases a model name and replaces anything that can't appear in a variable name
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
 }
 
 func (m ModelConfig) GetModelPath() string {
@@ -45,176 +234,406 @@ func (m ModelConfig) GetLabelFilePath() string {
 	return fmt.Sprintf("%s%s", m.Path, m.LabelFile)
 }
 
-type tfService struct {
-	bucket *blob.Bucket
-	labelMap map[int]*internal.Prediction
-	graph    *tensorflow.Graph
-	modelPath string
-	session *tensorflow.Session
+// TensorNames are the tensors predict feeds and fetches, written as an op name for its first output
+// or op:index. For SavedModels a name is first looked up as a signature key.
+type TensorNames struct {
+	Input string
+	Scores string
+	Classes string
+	NumDetections string
+	Boxes string
+	// Probabilities is the classification output, one score per class
+	Probabilities string
 }
 
+// Bucket is where model artifacts are read from, a *blob.Bucket or a verifying storage.ArtifactStore
+type Bucket interface {
+	ReadAll(ctx context.Context, key string) ([]byte, error)
+	Attributes(ctx context.Context, key string) (*blob.Attributes, error)
+	List(opts *blob.ListOptions) *blob.ListIterator
+}
+
+type tfService struct {
+	bucket Bucket
+	config ModelConfig
+	normalizers map[string]*normalizeGraph // keyed by decoder, built once
+
+	// mu guards the current model, which is loaded in the background and swapped on reload
+	mu      sync.RWMutex
+	state   internal.ModelState
+	current *model
+	closed  bool
+
+	// reloading makes sure only one new model is downloaded at a time
+	reloading sync.Mutex
+	done      chan struct{}
+	// draining counts replaced models still finishing their predictions
+	draining sync.WaitGroup
+}
 
-func NewTensorflowPredictor(bucket *blob.Bucket, modelPath, labelPath string) (internal.Predictor, error) {
+func newTensorflowService(bucket Bucket, config ModelConfig) (*tfService, error) {
 	s := &tfService{
 		bucket: bucket,
-		modelPath: modelPath,
+		config: config,
+		state: internal.ModelLoading,
+		done: make(chan struct{}),
+	}
+
+	normalizers, err := loadNormalizers(config.Input)
+	if err != nil {
+		logrus.WithError(err).Error("unable to create normalization graphs")
+		return nil, err
 	}
+	s.normalizers = normalizers
 
-	if err := s.loadLabelMap(labelPath); err != nil {
-		logrus.WithField("err", err).Error("unable to load map")
+	// the labels and other small files are read up front so a bad one fails startup, the model
+	// itself is downloaded in the background
+	files, err := s.loadFiles()
+	if err != nil {
+		closeNormalizers(normalizers)
 		return nil, err
 	}
+	go s.loadModel(files)
 
 	logrus.Info("service created")
 	return s, nil
 }
 
-func (s *tfService) Predict(img io.Reader) (internal.Predictions, error) {
+// State reports whether the model is loading, ready or failed to load
+func (s *tfService) State() internal.ModelState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// Close stops watching for new models and releases every tensorflow session held by the service,
+// waiting for in-flight predictions to finish before the normalizers they use are closed
+func (s *tfService) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	current := s.current
+	s.current = nil
+	s.mu.Unlock()
+
+	var err error
+	if current != nil {
+		err = current.drain()
+	}
+	s.draining.Wait()
+	closeNormalizers(s.normalizers)
+	return err
+}
+
+// loadModel downloads the first model next to the files read at startup, marking the service as
+// ready or failed, then watches for new versions if enabled
+func (s *tfService) loadModel(files *model) {
+	if err := s.reload(files); err != nil {
+		logrus.WithError(err).Error("unable to load model")
+	}
+	if s.config.WatchInterval > 0 {
+		s.watch(s.config.WatchInterval)
+	}
+}
+
+// acquire returns the current model or ErrModelUnavailable if no model is ready, the caller must
+// call release once done so the model can be closed after a reload
+func (s *tfService) acquire() (*model, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state != internal.ModelReady || s.current == nil {
+		return nil, internal.ErrModelUnavailable
+	}
+	s.current.inflight.Add(1)
+	return s.current, nil
+}
+
+func (s *tfService) Predict(img io.Reader, opts internal.PredictOptions) (internal.Result, error) {
+
+	m, err := s.acquire()
+	if err != nil {
+		return internal.Result{}, err
+	}
+	defer m.release()
+
+	// Get normalized tensor
+	tensor, width, height, meta, err := s.normalizeImage(img)
+	if err != nil {
+		logrus.WithError(err).Warn("unable to make a tensor from image")
+		return internal.Result{}, err
+	}
+
+	found, unknown, err := s.infer(m, tensor, []imageSize{{width, height}})
+	if err != nil {
+		return internal.Result{}, err
+	}
+	return s.result(m, found[0], unknown[0], meta, opts), nil
+}
+
+// imageSize is the upright size of an image before any resizing
+type imageSize struct {
+	width, height int
+}
 
-	if s.graph == nil {
-		err := s.loadGraphAndSession(s.modelPath)
+// infer runs a batch of images through the model, returning the predictions for each image in order
+// and, for images the rejection rule turned down, why
+func (s *tfService) infer(m *model, tensor *tensorflow.Tensor, sizes []imageSize) ([]internal.Predictions, []*internal.Unknown, error) {
+	found := make([]internal.Predictions, len(sizes))
+	unknown := make([]*internal.Unknown, len(sizes))
+	if s.config.Type == TypeClassification {
+		probabilities, err := s.classify(m, tensor)
 		if err != nil {
-			logrus.Fatal("unable to load model")
+			return nil, nil, err
+		}
+		for i := range found {
+			unknown[i] = s.rejectClasses(probabilities[i])
+			found[i] = m.classPredictions(probabilities[i], s.config.LabelOffset)
 		}
-		logrus.Info("loaded model")
+		return found, unknown, nil
 	}
-	// Get normalized tensor
-	tensor, err := s.normalizeImage(img)
+
+	detected, err := s.detect(m, tensor)
 	if err != nil {
-		log.Fatalf("unable to make a tensor from image: %v", err)
+		return nil, nil, err
+	}
+	for i, size := range sizes {
+		calibrateScores(detected[i].scores, m.temperature)
+		unknown[i] = s.rejectDetections(detected[i])
+		// Boxes are normalized so scaling by the original size undoes any resize
+		found[i] = m.predictions(detected[i], size.width, size.height)
 	}
+	return found, unknown, nil
+}
 
+// detect runs the model on a batch of images, returning the detections for each image in order
+func (s *tfService) detect(m *model, tensor *tensorflow.Tensor) ([]detections, error) {
 	now := time.Now()
-	logrus.Info("predicting")
-	output, err := s.session.Run(
+	logrus.WithFields(logrus.Fields{"batch": tensor.Shape()[0], "version": m.version}).Info("predicting")
+	output, err := m.session.Run(
 		map[tensorflow.Output]*tensorflow.Tensor{
-			s.graph.Operation("image_tensor").Output(0): tensor,
+			m.input: tensor,
 		},
 		[]tensorflow.Output{
-			s.graph.Operation("detection_scores").Output(0),
-			s.graph.Operation("detection_classes").Output(0),
-			s.graph.Operation("num_detections").Output(0),
-			s.graph.Operation("detection_boxes").Output(0),
+			m.scores,
+			m.classes,
+			m.num,
+			m.boxes,
 		},
 		nil)
 	if err != nil {
-		return nil, err
+		logrus.WithError(err).Error("unable to run model")
+		return nil, fmt.Errorf("%w: %v", internal.ErrInference, err)
 	}
 	processedTime := time.Now().Sub(now)
 	logrus.WithField("time", processedTime.String()).Info("predicting complete")
-	scores := output[0].Value().([][]float32)[0] //Maps to above tensorflow output detection_scores
-	ids := output[1].Value().([][]float32)[0]    //Maps to above tensorflow output detection_classes
 
-	var labels internal.Predictions
+	scores, okScores := output[0].Value().([][]float32)  //Maps to above tensorflow output detection_scores
+	classes, okClasses := output[1].Value().([][]float32) //Maps to above tensorflow output detection_classes
+	nums, okNums := output[2].Value().([]float32)         //Maps to above tensorflow output num_detections
+	boxes, okBoxes := output[3].Value().([][][]float32)   //Maps to above tensorflow output detection_boxes
+	if !okScores || !okClasses || !okNums || !okBoxes {
+		// configured tensor names that don't point at detection outputs
+		return nil, fmt.Errorf("%w: unexpected model output shapes", internal.ErrInference)
+	}
+
+	found := make([]detections, len(scores))
+	for i := range scores {
+		found[i] = detections{
+			scores:  scores[i],
+			classes: classes[i],
+			num:     int(nums[i]),
+			boxes:   boxes[i],
+		}
+	}
+	return found, nil
+}
 
-	for i, sc := range scores {
-		//todo len check
-		id := ids[i]
+// result adjusts and filters the predictions, the rollup is worked out before filtering so it sums
+// every prediction the request's include and exclude allow rather than only those returned. Photos
+// the model rejected get no predictions.
+func (s *tfService) result(m *model, labels internal.Predictions, unknown *internal.Unknown, meta metadata, opts internal.PredictOptions) internal.Result {
+	top := topPrediction(labels)
+	if unknown != nil {
+		return internal.Result{Predictions: internal.Predictions{}, Unknown: unknown, Top: top}
+	}
+	s.adjustForRange(m, labels, meta, opts)
+	s.adjustForSeason(m, labels, meta, opts)
 
-		label, ok := s.labelMap[int(id)]
-		if !ok {
-			logrus.WithField("id", id).Warn("id does not exist")
-			continue
+	result := internal.Result{Top: top}
+	if opts.Rollup != "" {
+		threshold := opts.RollupThreshold
+		if threshold == 0 {
+			threshold = s.config.RollupThreshold
 		}
-		label.Probability = sc * 100
-		labels = append(labels, label)
+		include := idSet(opts.Include)
+		exclude := idSet(opts.Exclude)
+		var allowed internal.Predictions
+		for _, l := range labels {
+			if (len(include) == 0 || include[l.ID]) && !exclude[l.ID] {
+				allowed = append(allowed, l)
+			}
+		}
+		result.Rollup = rollup(allowed, opts.Rollup, threshold)
 	}
+	result.Predictions = s.filter(labels, opts)
+	return result
+}
 
-	return labels, nil
+// topPrediction copies the most probable of the model's predictions, nil when there are none
+func topPrediction(labels internal.Predictions) *internal.Prediction {
+	var top *internal.Prediction
+	for _, l := range labels {
+		if top == nil || l.Probability > top.Probability {
+			top = l
+		}
+	}
+	if top == nil {
+		return nil
+	}
+	copied := *top
+	return &copied
 }
 
-func (s *tfService) loadLabelMap(path string) error {
-	logrus.WithField("path", path).Info("downloading labels")
-	labelsBytes, err := s.bucket.ReadAll(context.Background(), path)
-	if err != nil {
-		return err
+// filter sorts predictions by probability and applies the request's options, falling back to
+// the model's defaults. Classification models return at most TopK whatever the limit
+func (s *tfService) filter(labels internal.Predictions, opts internal.PredictOptions) internal.Predictions {
+	min, limit := s.config.MinProbability, s.config.Limit
+	if opts.MinProbability != nil {
+		min = *opts.MinProbability
 	}
-	logrus.Info("downloaded labels")
-	var labels []*internal.Prediction
-	if err := json.Unmarshal(labelsBytes, &labels); err != nil {
-		log.Fatal("unable to parse tags")
-		return err
+	if opts.Limit != nil {
+		limit = *opts.Limit
 	}
-	s.labelMap = make(map[int]*internal.Prediction)
+	if top := s.config.TopK; s.config.Type == TypeClassification && top > 0 && (limit == 0 || limit > top) {
+		limit = top
+	}
+	include := idSet(opts.Include)
+	exclude := idSet(opts.Exclude)
 
+	sort.Sort(labels)
+	filtered := labels[:0]
 	for _, l := range labels {
-		s.labelMap[l.ID] = l
+		if l.Score() < min {
+			// sorted, nothing after this passes either
+			break
+		}
+		if len(include) > 0 && !include[l.ID] {
+			continue
+		}
+		if exclude[l.ID] {
+			continue
+		}
+		filtered = append(filtered, l)
+		if limit > 0 && len(filtered) == limit {
+			break
+		}
 	}
-	logrus.Info("label map created")
-	return nil
+	return filtered
 }
 
+func idSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
 
-func (s *tfService) normalizeImage(body io.Reader) (*tensorflow.Tensor, error) {
-	var buf bytes.Buffer
-	io.Copy(&buf, body)
-	logrus.Info("normalizing image")
-	tensor, err := tensorflow.NewTensor(buf.String())
-	if err != nil {
-		return nil, err
+// detections holds the raw model output for a single image
+type detections struct {
+	scores  []float32
+	classes []float32
+	num     int
+	boxes   [][]float32
+}
+
+// predictions builds a fresh set of predictions for every detection so that
+// concurrent requests never share values from the label map
+func (m *model) predictions(d detections, width, height int) internal.Predictions {
+	num := d.num
+	if num > len(d.scores) {
+		num = len(d.scores)
 	}
 
-	graph, input, output, err := s.getNormalizedGraph()
-	if err != nil {
-		return nil, err
+	var labels internal.Predictions
+
+	for i, sc := range d.scores[:num] {
+		id := d.classes[i]
+
+		label, ok := m.labelMap[int(id)]
+		if !ok {
+			logrus.WithField("id", id).Warn("id does not exist")
+			continue
+		}
+		box := internal.Box{
+			YMin: d.boxes[i][0],
+			XMin: d.boxes[i][1],
+			YMax: d.boxes[i][2],
+			XMax: d.boxes[i][3],
+		}
+		pixelBox := box.ToPixels(width, height)
+
+		// label is a copy of the map value, safe to modify
+		label.Probability = sc * 100
+		label.Box = &box
+		label.PixelBox = &pixelBox
+		labels = append(labels, &label)
 	}
 
-	session, err := tensorflow.NewSession(graph, nil)
+	return labels
+}
+
+func (s *tfService) loadLabelMap(path string) (map[int]internal.Prediction, error) {
+	logrus.WithField("path", path).Info("downloading labels")
+	labelsBytes, err := s.bucket.ReadAll(context.Background(), path)
 	if err != nil {
 		return nil, err
 	}
-
-	normalized, err := session.Run(
-		map[tensorflow.Output]*tensorflow.Tensor{
-			input: tensor,
-		},
-		[]tensorflow.Output{
-			output,
-		},
-		nil)
+	logrus.Info("downloaded labels")
+	var labels []internal.Prediction
+	switch format := labelFormat(path, s.config.LabelFormat); format {
+	case LabelFormatPbtxt:
+		if labels, err = parsePbtxtLabels(labelsBytes); err == nil {
+			err = validateLabelIDs(labels)
+		}
+	case LabelFormatJSON:
+		err = json.Unmarshal(labelsBytes, &labels)
+	default:
+		return nil, fmt.Errorf("unknown label format %q, expected %s or %s", format, LabelFormatJSON, LabelFormatPbtxt)
+	}
 	if err != nil {
-		log.Fatal(err.Error())
-		return nil, err
+		return nil, fmt.Errorf("unable to parse labels: %w", err)
 	}
+	labelMap := make(map[int]internal.Prediction)
 
-	logrus.Info("image normalized")
-	return normalized[0], nil
-}
-
-// Creates a graph to decode, resize and normalize an image
-func (s *tfService) getNormalizedGraph() (graph *tensorflow.Graph, input, output tensorflow.Output, err error) {
-	scope := op.NewScope()
-	input = op.Placeholder(scope, tensorflow.String)
-	decode := op.DecodeJpeg(scope, input, op.DecodeJpegChannels(3))
-	output = op.ExpandDims(scope,
-		// cast image to uint8
-		op.Cast(scope, decode, tensorflow.Uint8),
-		op.Const(scope.SubScope("make_batch"), int32(0)))
-
-	graph, err = scope.Finalize()
-
-	return graph, input, output, err
+	for _, l := range labels {
+		labelMap[l.ID] = l
+	}
+	logrus.Info("label map created")
+	return labelMap, nil
 }
 
 
-
-func (s *tfService) loadGraphAndSession(path string) error {
+func (s *tfService) loadGraphAndSession(path string) (*tensorflow.Graph, *tensorflow.Session, error) {
 	// Load Model from bucket
-	// TODO load labels and models together
 	logrus.WithField("path", path).Info("downloading model")
 	model, err := s.bucket.ReadAll(context.Background(), path)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	logrus.Info("downloaded model")
-	s.graph = tensorflow.NewGraph()
-	if err := s.graph.Import(model, ""); err != nil {
-		return err
+	graph := tensorflow.NewGraph()
+	if err := graph.Import(model, ""); err != nil {
+		return nil, nil, err
 	}
-	s.session, err = tensorflow.NewSession(s.graph, nil)
+	session, err := tensorflow.NewSession(graph, nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	logrus.Info("model created")
-	return nil
+	return graph, session, nil
 }
\ No newline at end of file
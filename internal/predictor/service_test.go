@@ -0,0 +1,246 @@
+package predictor
+
+import (
+	"bytes"
+	"github.com/tensorflow/tensorflow/tensorflow/go"
+	"golang.org/x/image/bmp"
+	"image"
+	"nature-id-api/internal"
+	"nature-id-api/internal/storage"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSession answers every run with freshly built tensors, as tensorflow does
+type fakeSession struct {
+	outputs func() ([]*tensorflow.Tensor, error)
+	closed  int32
+}
+
+func (f *fakeSession) Run(map[tensorflow.Output]*tensorflow.Tensor, []tensorflow.Output, []*tensorflow.Operation) ([]*tensorflow.Tensor, error) {
+	return f.outputs()
+}
+
+func (f *fakeSession) Close() error {
+	atomic.StoreInt32(&f.closed, 1)
+	return nil
+}
+
+func (f *fakeSession) isClosed() bool {
+	return atomic.LoadInt32(&f.closed) == 1
+}
+
+func tensors(t testing.TB, values ...interface{}) func() ([]*tensorflow.Tensor, error) {
+	return func() ([]*tensorflow.Tensor, error) {
+		var out []*tensorflow.Tensor
+		for _, v := range values {
+			tensor, err := tensorflow.NewTensor(v)
+			if err != nil {
+				t.Error(err)
+				return nil, err
+			}
+			out = append(out, tensor)
+		}
+		return out, nil
+	}
+}
+
+// fakeDetectionService serves a detection model whose session always finds the given detections
+// in a 4x2 image
+func fakeDetectionService(t testing.TB, labels map[int]internal.Prediction, d detections) *tfService {
+	pixels := make([][][][]uint8, 1)
+	pixels[0] = make([][][]uint8, 2)
+	for y := range pixels[0] {
+		pixels[0][y] = make([][]uint8, 4)
+		for x := range pixels[0][y] {
+			pixels[0][y][x] = make([]uint8, 3)
+		}
+	}
+	normalizers := map[string]*normalizeGraph{
+		decodedPixels: {session: &fakeSession{outputs: tensors(t, pixels)}},
+	}
+	m := &model{
+		session: &fakeSession{outputs: tensors(t,
+			[][]float32{d.scores},
+			[][]float32{d.classes},
+			[]float32{float32(d.num)},
+			[][][]float32{d.boxes},
+		)},
+		labelMap:    labels,
+		version:     "test",
+		temperature: 1,
+	}
+	return &tfService{
+		normalizers: normalizers,
+		state:       internal.ModelReady,
+		current:     m,
+		done:        make(chan struct{}),
+	}
+}
+
+// fileBucketService reads its model from the storage package's file:// fixture bucket
+func fileBucketService(t *testing.T) (*tfService, func() error) {
+	t.Helper()
+	dir, err := filepath.Abs("../storage/testdata/bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := storage.NewBucketStorage(storage.BucketConfig{ConnectionString: "file://" + filepath.ToSlash(dir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tfService{
+		bucket: bucket,
+		config: ModelConfig{Path: "models/test/", Name: "model.pb", LabelFile: "labels.json"},
+	}, bucket.Close
+}
+
+func bmpImage(t testing.TB, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := bmp.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestPredictConcurrent runs predictions in parallel, under -race it catches requests writing to
+// the shared label map
+func TestPredictConcurrent(t *testing.T) {
+	labels := map[int]internal.Prediction{
+		1: {ID: 1, Name: "robin"},
+		2: {ID: 2, Name: "wren"},
+	}
+	s := fakeDetectionService(t, labels, detections{
+		scores:  []float32{0.9, 0.5},
+		classes: []float32{1, 2},
+		num:     2,
+		boxes:   [][]float32{{0, 0, 1, 1}, {0, 0, 0.5, 0.5}},
+	})
+	img := bmpImage(t, 4, 2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				result, err := s.Predict(bytes.NewReader(img), internal.PredictOptions{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(result.Predictions) != 2 {
+					t.Errorf("got %d predictions, want 2", len(result.Predictions))
+					return
+				}
+				top := result.Predictions[0]
+				if top.Name != "robin" || top.Probability != 90 || top.PixelBox == nil || top.PixelBox.XMax != 4 {
+					t.Errorf("unexpected top prediction %+v", top)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id, l := range labels {
+		if l.Probability != 0 || l.Box != nil || l.PixelBox != nil {
+			t.Errorf("label %d was modified: %+v", id, l)
+		}
+	}
+}
+
+func TestFilterExplicitZero(t *testing.T) {
+	s := &tfService{config: ModelConfig{MinProbability: 1, Limit: 1}}
+	labels := func() internal.Predictions {
+		return internal.Predictions{
+			{ID: 1, Probability: 60},
+			{ID: 2, Probability: 30},
+			{ID: 3, Probability: 0.5},
+		}
+	}
+	zero, none := float32(0), 0
+
+	if got := s.filter(labels(), internal.PredictOptions{}); len(got) != 1 {
+		t.Errorf("defaults kept %d predictions, want 1", len(got))
+	}
+	if got := s.filter(labels(), internal.PredictOptions{MinProbability: &zero, Limit: &none}); len(got) != 3 {
+		t.Errorf("min_probability=0 and limit=0 kept %d predictions, want 3", len(got))
+	}
+}
+
+func TestLoadLabelMapFromFileBucket(t *testing.T) {
+	s, closeBucket := fileBucketService(t)
+	defer closeBucket()
+	labels, err := s.loadLabelMap(s.config.GetLabelFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 2 || labels[1].Name != "Turdus migratorius" || labels[2].DisplayName != "House Wren" {
+		t.Errorf("unexpected labels %+v", labels)
+	}
+}
+
+// TestLoadGraphFromFileBucket imports the fixture's one op graph, it needs libtensorflow
+func TestLoadGraphFromFileBucket(t *testing.T) {
+	s, closeBucket := fileBucketService(t)
+	defer closeBucket()
+	graph, session, err := s.loadGraphAndSession(s.config.GetModelPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if graph.Operation("image_tensor") == nil {
+		t.Error("image_tensor is missing from the imported graph")
+	}
+}
+
+// TestCloseDrainsBeforeNormalizers checks Close leaves the normalizers open until predictions
+// holding the current or a replaced model finish
+func TestCloseDrainsBeforeNormalizers(t *testing.T) {
+	s := fakeDetectionService(t, map[int]internal.Prediction{1: {ID: 1}}, detections{})
+	normalizer := s.normalizers[decodedPixels].session.(*fakeSession)
+
+	current, err := s.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a replaced model still finishing a prediction, as Reload leaves it
+	replaced := &model{session: &fakeSession{}}
+	replaced.inflight.Add(1)
+	s.draining.Add(1)
+	go func() {
+		defer s.draining.Done()
+		replaced.drain()
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	for _, m := range []*model{current, replaced} {
+		time.Sleep(20 * time.Millisecond)
+		if normalizer.isClosed() {
+			t.Fatal("normalizers closed while a prediction was running")
+		}
+		m.release()
+	}
+	<-closed
+	if !normalizer.isClosed() {
+		t.Error("normalizers left open")
+	}
+}
+
+// TestLoadFilesBadLabels checks a broken label file is reported by loadFiles, which runs before
+// the service is created
+func TestLoadFilesBadLabels(t *testing.T) {
+	s, closeBucket := fileBucketService(t)
+	defer closeBucket()
+	s.config.LabelFile = "model.pb"
+	if _, err := s.loadFiles(); err == nil {
+		t.Error("loaded a graph as labels")
+	}
+}
@@ -0,0 +1,34 @@
+package internal
+
+// RouteMode is how a candidate model gets traffic
+type RouteMode string
+
+const (
+	// RouteSplit answers a share of requests with the candidate
+	RouteSplit RouteMode = "split"
+	// RouteShadow runs the candidate in the background, the primary always answers
+	RouteShadow RouteMode = "shadow"
+)
+
+// RoutingStats compares a candidate model with the primary model on live traffic
+type RoutingStats struct {
+	Primary   string    `json:"primary"`
+	Candidate string    `json:"candidate"`
+	Mode      RouteMode `json:"mode"`
+	Percent   float64   `json:"percent"`
+
+	PrimaryRequests   int64 `json:"primary_requests"`
+	CandidateRequests int64 `json:"candidate_requests"`
+
+	// shadow comparisons, dropped counts shadow runs skipped because too many were already running
+	Shadowed     int64   `json:"shadowed"`
+	ShadowErrors int64   `json:"shadow_errors"`
+	Dropped      int64   `json:"dropped"`
+	Agreed       int64   `json:"agreed"`
+	Disagreed    int64   `json:"disagreed"`
+	Agreement    float64 `json:"agreement"`
+}
+
+type RoutingMonitor interface {
+	RoutingStats() RoutingStats
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrChecksumMismatch is returned when an artifact doesn't match its manifest entry
+	ErrChecksumMismatch = errors.New("artifact checksum does not match manifest")
+	// ErrUnverified is returned for artifacts without a manifest when RequireManifest is set
+	ErrUnverified = errors.New("no manifest to verify artifact")
+)
+
+type ArtifactConfig struct {
+	// CacheDir keeps verified artifacts between restarts, empty disables the cache
+	CacheDir string
+	// Manifest is the file name of the sha256sum style manifest stored next to the artifacts
+	Manifest string
+	// RequireManifest refuses artifacts from directories without a manifest, otherwise they're read
+	// unchecked and uncached with a warning
+	RequireManifest bool
+}
+
+func LoadArtifactConfig() ArtifactConfig {
+	return ArtifactConfig{
+		CacheDir:        os.Getenv("MODEL_CACHE_DIR"),
+		Manifest:        GetEnv("MODEL_MANIFEST", "SHA256SUMS"),
+		RequireManifest: os.Getenv("MODEL_REQUIRE_MANIFEST") == "true",
+	}
+}
+
+// ArtifactStore reads model artifacts from a bucket, checking them against the SHA-256 manifest
+// in the same directory and reusing verified copies from the local cache
+type ArtifactStore struct {
+	bucket *blob.Bucket
+	config ArtifactConfig
+}
+
+func NewArtifactStore(bucket *blob.Bucket, config ArtifactConfig) *ArtifactStore {
+	return &ArtifactStore{bucket: bucket, config: config}
+}
+
+func (a *ArtifactStore) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	manifest, err := a.manifest(ctx, path.Dir(key))
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		if a.config.RequireManifest {
+			return nil, fmt.Errorf("%w: %s has no %s", ErrUnverified, key, a.config.Manifest)
+		}
+		logrus.WithField("key", key).Warn("no manifest found, artifact will not be verified or cached")
+		return a.bucket.ReadAll(ctx, key)
+	}
+	// the manifest is in the artifact's directory so the path relative to it is the file name
+	expected, ok := manifest[path.Base(key)]
+	if !ok {
+		return nil, fmt.Errorf("%s is not listed in the manifest", key)
+	}
+
+	if data, ok := a.cached(key, expected); ok {
+		logrus.WithField("key", key).Info("using cached artifact")
+		return data, nil
+	}
+
+	data, err := a.bucket.ReadAll(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if sum := checksum(data); sum != expected {
+		logrus.WithFields(logrus.Fields{"key": key, "expected": expected, "actual": sum}).Error("refusing artifact")
+		return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, key)
+	}
+	a.store(key, data)
+	return data, nil
+}
+
+// Attributes reads an artifact's attributes straight from the bucket, used to notice new versions
+func (a *ArtifactStore) Attributes(ctx context.Context, key string) (*blob.Attributes, error) {
+	return a.bucket.Attributes(ctx, key)
+}
+
+// List lists artifacts straight from the bucket
+func (a *ArtifactStore) List(opts *blob.ListOptions) *blob.ListIterator {
+	return a.bucket.List(opts)
+}
+
+// manifest reads the checksums for a directory, falling back to the cached copy when the bucket
+// can't be reached, a nil map means there is no manifest
+func (a *ArtifactStore) manifest(ctx context.Context, dir string) (map[string]string, error) {
+	key := path.Join(dir, a.config.Manifest)
+	data, err := a.bucket.ReadAll(ctx, key)
+	switch {
+	case err == nil:
+		a.store(key, data)
+	case gcerrors.Code(err) == gcerrors.NotFound:
+		return nil, nil
+	case a.config.CacheDir != "":
+		cached, cacheErr := ioutil.ReadFile(a.cachePath(key))
+		if cacheErr != nil {
+			return nil, fmt.Errorf("unable to read manifest: %w", err)
+		}
+		logrus.WithError(err).Warn("unable to read manifest from bucket, using cached copy")
+		data = cached
+	default:
+		return nil, fmt.Errorf("unable to read manifest: %w", err)
+	}
+	return parseManifest(data)
+}
+
+// parseManifest reads sha256sum output, one "<hex digest>  <file name>" per line, keyed by the path
+// relative to the manifest so files listed in subdirectories never stand in for ones next to it
+func parseManifest(data []byte) (map[string]string, error) {
+	manifest := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid manifest line: %q", line)
+		}
+		// sha256sum marks binary mode files with a leading *
+		name := path.Clean(strings.TrimPrefix(fields[1], "*"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("manifest entry outside its directory: %q", line)
+		}
+		manifest[name] = strings.ToLower(fields[0])
+	}
+	return manifest, scanner.Err()
+}
+
+func (a *ArtifactStore) cachePath(key string) string {
+	return filepath.Join(a.config.CacheDir, filepath.FromSlash(key))
+}
+
+// cached returns the local copy of an artifact if it matches the expected checksum
+func (a *ArtifactStore) cached(key, expected string) ([]byte, bool) {
+	if a.config.CacheDir == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(a.cachePath(key))
+	if err != nil {
+		return nil, false
+	}
+	if checksum(data) != expected {
+		logrus.WithField("key", key).Warn("cached artifact is stale or corrupt, downloading again")
+		return nil, false
+	}
+	return data, true
+}
+
+// store writes an artifact to the cache, failures only cost a download on the next start
+func (a *ArtifactStore) store(key string, data []byte) {
+	if a.config.CacheDir == "" {
+		return
+	}
+	dest := a.cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		logrus.WithError(err).Warn("unable to create cache directory")
+		return
+	}
+	// write then rename so a crash never leaves a partial file behind
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".*")
+	if err != nil {
+		logrus.WithError(err).Warn("unable to cache artifact")
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logrus.WithError(err).Warn("unable to cache artifact")
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArtifactStoreVerifies(t *testing.T) {
+	bucket, err := NewBucketStorage(BucketConfig{ConnectionString: fixtureBucket(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	cache, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	a := NewArtifactStore(bucket, ArtifactConfig{CacheDir: cache, Manifest: "SHA256SUMS"})
+
+	want, err := ioutil.ReadFile("testdata/bucket/models/test/labels.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := a.ReadAll(context.Background(), "models/test/labels.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(want) {
+		t.Errorf("read %q, want %q", data, want)
+	}
+
+	// a tampered cached copy is downloaded again rather than used
+	cached := filepath.Join(cache, "models", "test", "labels.json")
+	if err := ioutil.WriteFile(cached, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := a.ReadAll(context.Background(), "models/test/labels.json"); err != nil || string(data) != string(want) {
+		t.Errorf("read %q, %v after tampering with the cache", data, err)
+	}
+}
+
+func TestArtifactStoreRefuses(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := NewBucketStorage(BucketConfig{ConnectionString: "mem://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	for key, data := range map[string]string{
+		"verified/labels.json":   "[]",
+		"verified/SHA256SUMS":    checksum([]byte("[1]")) + "  labels.json\n",
+		"unverified/labels.json": "[]",
+	} {
+		if err := bucket.WriteAll(ctx, key, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		key             string
+		requireManifest bool
+		want            error
+	}{
+		{"verified/labels.json", false, ErrChecksumMismatch},
+		{"verified/labels.json", true, ErrChecksumMismatch},
+		{"unverified/labels.json", false, nil},
+		{"unverified/labels.json", true, ErrUnverified},
+	}
+	for _, tt := range tests {
+		a := NewArtifactStore(bucket, ArtifactConfig{Manifest: "SHA256SUMS", RequireManifest: tt.requireManifest})
+		_, err := a.ReadAll(ctx, tt.key)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s with manifest required %v: got %v, want %v", tt.key, tt.requireManifest, err, tt.want)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"ABC  model.pb\n# comment\n\ndef *labels.json\n", map[string]string{"model.pb": "abc", "labels.json": "def"}, false},
+		{"abc  variables/variables.index\ndef  ./variables.index\n", map[string]string{"variables/variables.index": "abc", "variables.index": "def"}, false},
+		{"abc  ../model.pb\n", nil, true},
+		{"abc  /model.pb\n", nil, true},
+		{"abc\n", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseManifest([]byte(tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseManifest(%q) returned %v, want error %v", tt.data, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseManifest(%q) = %v, want %v", tt.data, got, tt.want)
+			continue
+		}
+		for name, sum := range tt.want {
+			if got[name] != sum {
+				t.Errorf("parseManifest(%q) = %v, want %v", tt.data, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// TestArtifactStoreSubdirectoryEntries checks an entry for a file in a subdirectory isn't used for a
+// file with the same name next to the manifest
+func TestArtifactStoreSubdirectoryEntries(t *testing.T) {
+	ctx := context.Background()
+	bucket, err := NewBucketStorage(BucketConfig{ConnectionString: "mem://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	for key, data := range map[string]string{
+		"model/variables.index":           "top",
+		"model/variables/variables.index": "nested",
+		"model/SHA256SUMS":                checksum([]byte("top")) + "  variables/variables.index\n",
+	} {
+		if err := bucket.WriteAll(ctx, key, []byte(data), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := NewArtifactStore(bucket, ArtifactConfig{Manifest: "SHA256SUMS"})
+	if data, err := a.ReadAll(ctx, "model/variables.index"); err == nil {
+		t.Errorf("read %q verified by the entry for variables/variables.index", data)
+	}
+}
@@ -1,12 +1,24 @@
 package storage
 
 import (
+	"cloud.google.com/go/compute/metadata"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/sirupsen/logrus"
+	gcaws "gocloud.dev/aws"
 	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
 	"gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/memblob"
+	"gocloud.dev/blob/s3blob"
 	"gocloud.dev/gcp"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
 	"net/url"
 	"os"
 )
@@ -36,33 +48,57 @@ func LoadBucketConfig() BucketConfig {
 	}
 }
 
-func NewGCPBucketStorage(config BucketConfig) (*blob.Bucket, error) {
+// NewBucketStorage opens any gocloud bucket url, gs:// and s3:// look up credentials for their
+// cloud while file:// and mem:// need none, handy for running locally
+func NewBucketStorage(config BucketConfig) (*blob.Bucket, error) {
 	ctx := context.Background()
 
-	urlString := config.ConnectionString
-	urlParts, _ := url.Parse(urlString)
+	urlParts, err := url.Parse(config.ConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bucket url: %w", err)
+	}
+
+	switch urlParts.Scheme {
+	case gcsblob.Scheme:
+		return newGCPBucketStorage(ctx, config, urlParts)
+	case s3blob.Scheme:
+		return newS3BucketStorage(ctx, config, urlParts)
+	default:
+		return blob.OpenBucket(ctx, config.ConnectionString)
+	}
+}
+
+func newGCPBucketStorage(ctx context.Context, config BucketConfig, urlParts *url.URL) (*blob.Bucket, error) {
 	// Your GCP credentials.
 	// See https://cloud.google.com/docs/authentication/production
 	// for more info on alternatives.
 	creds, err := gcp.DefaultCredentials(ctx)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, fmt.Errorf("unable to find gcp credentials: %w", err)
 	}
 
 	accessID := config.AccessID
 	accessKey := config.AccessKey
 
-	if accessID == "" || accessKey == "" {
+	opts := &gcsblob.Options{}
+	switch {
+	case accessID != "" && accessKey != "":
+		opts.GoogleAccessID = accessID
+		opts.PrivateKey = []byte(accessKey)
+	case len(creds.JSON) > 0:
 		logrus.Warn("unable to find access information using default credentials")
 		credsMap := make(map[string]string)
-		json.Unmarshal(creds.JSON, &credsMap)
-		accessID = credsMap["client_id"]
-		accessKey = credsMap["private_key"]
-	}
-
-	opts := &gcsblob.Options{
-		GoogleAccessID: accessID,
-		PrivateKey:     []byte(accessKey),
+		if err := json.Unmarshal(creds.JSON, &credsMap); err != nil {
+			return nil, fmt.Errorf("unable to read gcp credentials: %w", err)
+		}
+		opts.GoogleAccessID = credsMap["client_id"]
+		opts.PrivateKey = []byte(credsMap["private_key"])
+	default:
+		// GCE and GKE metadata credentials have no json and no private key
+		opts.GoogleAccessID, opts.SignBytes, err = keylessSigner(ctx, creds)
+		if err != nil {
+			logrus.WithError(err).Warn("unable to sign urls with metadata credentials")
+		}
 	}
 	// Create an HTTP client.
 	// This example uses the default HTTP transport and the credentials
@@ -71,9 +107,58 @@ func NewGCPBucketStorage(config BucketConfig) (*blob.Bucket, error) {
 		gcp.DefaultTransport(),
 		gcp.CredentialsTokenSource(creds))
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
 
 	// Create a *blob.Bucket.
 	return gcsblob.OpenBucket(ctx, client, urlParts.Host, opts)
-}
\ No newline at end of file
+}
+
+// keylessSigner signs through the IAM credentials api as the instance's service account, which
+// needs the iam.serviceAccounts.signBlob permission on itself
+func keylessSigner(ctx context.Context, creds *google.Credentials) (string, func([]byte) ([]byte, error), error) {
+	email, err := metadata.Get("instance/service-accounts/default/email")
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to find service account: %w", err)
+	}
+	iam, err := iamcredentials.NewService(ctx, option.WithTokenSource(creds.TokenSource))
+	if err != nil {
+		return "", nil, err
+	}
+	name := "projects/-/serviceAccounts/" + email
+	sign := func(b []byte) ([]byte, error) {
+		res, err := iam.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+			Payload: base64.StdEncoding.EncodeToString(b),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(res.SignedBlob)
+	}
+	return email, sign, nil
+}
+
+func newS3BucketStorage(ctx context.Context, config BucketConfig, urlParts *url.URL) (*blob.Bucket, error) {
+	// region, endpoint and similar settings come from the url query, e.g. s3://bucket?region=us-east-1
+	awsConfig, err := gcaws.ConfigFromURLParams(urlParts.Query())
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 bucket url: %w", err)
+	}
+	if config.AccessID != "" && config.AccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.AccessID, config.AccessKey, "")
+	}
+
+	// Without explicit keys the usual AWS environment, shared config and instance role chain is used
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create aws session: %w", err)
+	}
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, fmt.Errorf("unable to find aws credentials: %w", err)
+	}
+
+	return s3blob.OpenBucket(ctx, sess, urlParts.Host, nil)
+}
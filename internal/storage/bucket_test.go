@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// fixtureBucket is a file:// url for testdata/bucket, which holds a one op graph and its labels
+func fixtureBucket(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.Abs("testdata/bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + filepath.ToSlash(dir)
+}
+
+func TestFileBucket(t *testing.T) {
+	bucket, err := NewBucketStorage(BucketConfig{ConnectionString: fixtureBucket(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+
+	for _, key := range []string{"models/test/model.pb", "models/test/labels.json"} {
+		data, err := bucket.ReadAll(context.Background(), key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if len(data) == 0 {
+			t.Errorf("%s is empty", key)
+		}
+	}
+	if _, err := bucket.ReadAll(context.Background(), "models/test/missing.pb"); err == nil {
+		t.Error("read a missing key")
+	}
+}
+
+func TestNewBucketStorageErrors(t *testing.T) {
+	for _, url := range []string{"unknown://bucket", "://bucket"} {
+		if bucket, err := NewBucketStorage(BucketConfig{ConnectionString: url}); err == nil {
+			bucket.Close()
+			t.Errorf("%s opened without error", url)
+		}
+	}
+}
+
+func TestMemBucket(t *testing.T) {
+	bucket, err := NewBucketStorage(BucketConfig{ConnectionString: "mem://"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.Close()
+	if err := bucket.WriteAll(context.Background(), "labels.json", []byte("[]"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := bucket.ReadAll(context.Background(), "labels.json"); err != nil || string(data) != "[]" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+}
@@ -0,0 +1,4 @@
+
+(
+image_tensorPlaceholder*
+dtype0
\ No newline at end of file
@@ -0,0 +1,84 @@
+package internal
+
+// Ranks are the taxonomic ranks from broadest to narrowest
+var Ranks = []string{"kingdom", "phylum", "class", "order", "family", "genus", "species"}
+
+// RankIndex returns the position of a rank in Ranks, or -1 if it isn't one
+func RankIndex(rank string) int {
+	for i, r := range Ranks {
+		if r == rank {
+			return i
+		}
+	}
+	return -1
+}
+
+// Taxonomy places a label in the tree of life, ranks that aren't known are left empty
+type Taxonomy struct {
+	Kingdom string `json:"kingdom,omitempty"`
+	Phylum  string `json:"phylum,omitempty"`
+	Class   string `json:"class,omitempty"`
+	Order   string `json:"order,omitempty"`
+	Family  string `json:"family,omitempty"`
+	Genus   string `json:"genus,omitempty"`
+	Species string `json:"species,omitempty"`
+}
+
+// field returns the field holding a rank, nil for unknown ranks
+func (t *Taxonomy) field(rank string) *string {
+	switch rank {
+	case "kingdom":
+		return &t.Kingdom
+	case "phylum":
+		return &t.Phylum
+	case "class":
+		return &t.Class
+	case "order":
+		return &t.Order
+	case "family":
+		return &t.Family
+	case "genus":
+		return &t.Genus
+	case "species":
+		return &t.Species
+	}
+	return nil
+}
+
+// At returns the taxon at a rank
+func (t *Taxonomy) At(rank string) string {
+	if f := t.field(rank); f != nil {
+		return *f
+	}
+	return ""
+}
+
+// Set sets the taxon at a rank, reporting false for unknown ranks
+func (t *Taxonomy) Set(rank, name string) bool {
+	f := t.field(rank)
+	if f == nil {
+		return false
+	}
+	*f = name
+	return true
+}
+
+// Above returns a copy keeping only the given rank and those broader than it
+func (t *Taxonomy) Above(rank string) *Taxonomy {
+	above := &Taxonomy{}
+	for _, r := range Ranks[:RankIndex(rank)+1] {
+		above.Set(r, t.At(r))
+	}
+	return above
+}
+
+// Rollup is the narrowest taxon whose summed probability passed the threshold, or the taxon at the
+// requested rank when none did
+type Rollup struct {
+	Rank        string    `json:"rank"`
+	Name        string    `json:"name"`
+	Probability float32   `json:"probability"`
+	Threshold   float32   `json:"threshold"`
+	Confident   bool      `json:"confident"`
+	Taxonomy    *Taxonomy `json:"taxonomy"`
+}
@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DeadLetter is a callback that could not be delivered
+type DeadLetter struct {
+	JobID    string          `json:"job_id"`
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+type DeadLetterStore interface {
+	Put(letter DeadLetter)
+	List() []DeadLetter
+}
+
+type memoryDeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+	max     int
+}
+
+// NewMemoryDeadLetters keeps the most recent max dead letters
+func NewMemoryDeadLetters(max int) DeadLetterStore {
+	return &memoryDeadLetters{max: max}
+}
+
+func (m *memoryDeadLetters) Put(letter DeadLetter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.letters = append(m.letters, letter)
+	if len(m.letters) > m.max {
+		m.letters = m.letters[len(m.letters)-m.max:]
+	}
+}
+
+func (m *memoryDeadLetters) List() []DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DeadLetter(nil), m.letters...)
+}
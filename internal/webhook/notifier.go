@@ -0,0 +1,266 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"nature-id-api/internal"
+	"nature-id-api/internal/jobs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader holds the hex encoded HMAC-SHA256, keyed with WEBHOOK_SECRET, of the signed
+	// headers and the request body
+	SignatureHeader = "X-Signature-256"
+	// TimestampHeader holds the unix time the callback was signed at, receivers should refuse old
+	// ones so a captured callback can't be replayed
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+// SignedHeaders are covered by the signature along with the body, in this order
+var SignedHeaders = []string{TimestampHeader, "X-Job-Id", "X-Job-Status", internal.UnknownHeader}
+
+func getEnvInt(env string, fallback int) int {
+	e, err := strconv.Atoi(os.Getenv(env))
+	if err != nil {
+		return fallback
+	}
+	return e
+}
+
+type WebhookConfig struct {
+	Secret      string
+	MaxAttempts int
+	BaseDelay   time.Duration
+	Timeout     time.Duration
+	// AllowPrivate lets callbacks reach loopback, private and link-local addresses
+	AllowPrivate bool
+}
+
+func LoadWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Secret:       os.Getenv("WEBHOOK_SECRET"),
+		MaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		BaseDelay:    time.Duration(getEnvInt("WEBHOOK_BASE_DELAY_MS", 1000)) * time.Millisecond,
+		Timeout:      time.Duration(getEnvInt("WEBHOOK_TIMEOUT_MS", 10000)) * time.Millisecond,
+		AllowPrivate: os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true",
+	}
+}
+
+// Notifier delivers job callbacks, Close waits for deliveries in flight
+type Notifier interface {
+	jobs.Notifier
+	Close() error
+}
+
+type notifier struct {
+	config      WebhookConfig
+	client      *http.Client
+	deadLetters DeadLetterStore
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewNotifier returns an error without a secret, every callback must be signed
+func NewNotifier(config WebhookConfig, deadLetters DeadLetterStore) (Notifier, error) {
+	if config.Secret == "" {
+		return nil, errors.New("WEBHOOK_SECRET must be set to sign callbacks")
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !config.AllowPrivate {
+		dialer.Control = publicOnly
+	}
+	return &notifier{
+		config: config,
+		client: &http.Client{
+			Timeout: config.Timeout,
+			// no proxy, the address check has to see the callback host itself
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				MaxIdleConns:        100,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+			// a redirect could point anywhere, treat it as a failed delivery
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		deadLetters: deadLetters,
+		done:        make(chan struct{}),
+	}, nil
+}
+
+// Notify delivers the job's predictions to its callback url in the background
+func (n *notifier) Notify(job internal.Job) {
+	if job.CallbackURL == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		logrus.WithField("id", job.ID).Error("callback not sent, notifier is closed")
+		return
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.deliver(job)
+	}()
+}
+
+// Close stops retrying and waits for deliveries in flight, callbacks still waiting to be retried
+// become dead letters
+func (n *notifier) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.done)
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+	return nil
+}
+
+// permanentError is a failed delivery that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// deliver posts to the callback url, backing off exponentially between attempts, and records
+// a dead letter once every attempt has failed. Only network errors and 5xx responses are retried
+func (n *notifier) deliver(job internal.Job) {
+	predictions := job.Predictions
+	if predictions == nil {
+		predictions = internal.Predictions{}
+	}
+	// same shape as the predict response, the envelope only for a rollup or a rejected photo
+	var body interface{} = predictions
+	if job.Rollup != nil || job.Unknown != nil {
+		body = internal.Result{Predictions: predictions, Rollup: job.Rollup, Unknown: job.Unknown}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		logrus.WithError(err).WithField("id", job.ID).Error("unable to marshal callback payload")
+		return
+	}
+
+	delay := n.config.BaseDelay
+	attempt := 1
+	for ; ; attempt++ {
+		err = n.post(job, payload)
+		if err == nil {
+			logrus.WithFields(logrus.Fields{"id": job.ID, "attempt": attempt}).Info("callback delivered")
+			return
+		}
+		logrus.WithError(err).WithFields(logrus.Fields{"id": job.ID, "attempt": attempt}).Warn("callback failed")
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= n.config.MaxAttempts {
+			break
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-n.done:
+			timer.Stop()
+			err = fmt.Errorf("shut down before retrying: %w", err)
+		}
+		if n.isClosed() {
+			break
+		}
+		delay *= 2
+	}
+
+	logrus.WithError(err).WithField("id", job.ID).Error("giving up on callback")
+	n.deadLetters.Put(DeadLetter{
+		JobID:    job.ID,
+		URL:      job.CallbackURL,
+		Payload:  payload,
+		Attempts: attempt,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+	})
+}
+
+func (n *notifier) isClosed() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.closed
+}
+
+func (n *notifier) post(job internal.Job, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, job.CallbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("X-Job-Id", job.ID)
+	req.Header.Set("X-Job-Status", string(job.Status))
+	if job.Unknown != nil {
+		req.Header.Set(internal.UnknownHeader, "true")
+	}
+	// signed on every attempt so retries carry a fresh timestamp
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(n.config.Secret, req.Header, payload))
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedAddress) {
+			return &permanentError{err}
+		}
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode >= 500:
+		return fmt.Errorf("callback responded with %s", res.Status)
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return &permanentError{fmt.Errorf("callback responded with %s", res.Status)}
+	}
+	return nil
+}
+
+// Sign returns the signature header value, an HMAC-SHA256 over each of SignedHeaders as a
+// lowercase "name:value" line followed by the body. Receivers should use Verify
+func Sign(secret string, header http.Header, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, name := range SignedHeaders {
+		fmt.Fprintf(mac, "%s:%s\n", strings.ToLower(name), header.Get(name))
+	}
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a callback's signature and that it was signed within tolerance of now
+func Verify(secret string, header http.Header, payload []byte, now time.Time, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", TimestampHeader)
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("callback was signed %s ago", age)
+	}
+	if !hmac.Equal([]byte(Sign(secret, header, payload)), []byte(header.Get(SignatureHeader))) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
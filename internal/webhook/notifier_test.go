@@ -0,0 +1,323 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"nature-id-api/internal"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "test secret"
+
+// receiver records every callback and answers with the next of its statuses, then 200
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) count() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return len(rc.requests)
+}
+
+// wait gives the notifier up to a second to make n attempts, Close would cut retries short
+func (rc *receiver) wait(n int) {
+	deadline := time.Now().Add(time.Second)
+	for rc.count() < n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testNotifier(t *testing.T, config WebhookConfig) (Notifier, DeadLetterStore) {
+	t.Helper()
+	if config.Secret == "" {
+		config.Secret = testSecret
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 3
+	}
+	config.BaseDelay = time.Millisecond
+	config.Timeout = time.Second
+	deadLetters := NewMemoryDeadLetters(10)
+	n, err := NewNotifier(config, deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, deadLetters
+}
+
+func testJob(url string) internal.Job {
+	return internal.Job{
+		ID:          "job-1",
+		Status:      internal.JobDone,
+		CallbackURL: url,
+		Predictions: internal.Predictions{{ID: 1, Name: "robin", Probability: 90}},
+	}
+}
+
+func TestNewNotifierRequiresSecret(t *testing.T) {
+	if _, err := NewNotifier(WebhookConfig{}, NewMemoryDeadLetters(1)); err == nil {
+		t.Error("notifier created without a secret")
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	n, deadLetters := testNotifier(t, WebhookConfig{AllowPrivate: true})
+
+	n.Notify(testJob(server.URL))
+	n.Close()
+
+	if rc.count() != 1 {
+		t.Fatalf("got %d callbacks, want 1", rc.count())
+	}
+	r, body := rc.requests[0], rc.bodies[0]
+	if r.Header.Get("X-Job-Id") != "job-1" || r.Header.Get("X-Job-Status") != string(internal.JobDone) {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+	if err := Verify(testSecret, r.Header, body, time.Now(), time.Minute); err != nil {
+		t.Errorf("callback does not verify: %v", err)
+	}
+	if letters := deadLetters.List(); len(letters) != 0 {
+		t.Errorf("delivered callback left dead letters %v", letters)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	payload := []byte(`[{"id":1}]`)
+	signed := func() http.Header {
+		h := http.Header{}
+		h.Set("X-Job-Id", "job-1")
+		h.Set("X-Job-Status", "done")
+		h.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+		h.Set(SignatureHeader, Sign(testSecret, h, payload))
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(h http.Header) []byte
+		wantErr bool
+	}{
+		{"untouched", func(h http.Header) []byte { return payload }, false},
+		{"body", func(h http.Header) []byte { return []byte(`[{"id":2}]`) }, true},
+		{"job id", func(h http.Header) []byte { h.Set("X-Job-Id", "job-2"); return payload }, true},
+		{"status", func(h http.Header) []byte { h.Set("X-Job-Status", "failed"); return payload }, true},
+		{"unknown", func(h http.Header) []byte { h.Set(internal.UnknownHeader, "true"); return payload }, true},
+		{"timestamp", func(h http.Header) []byte {
+			h.Set(TimestampHeader, strconv.FormatInt(now.Unix()+1, 10))
+			return payload
+		}, true},
+		{"secret", func(h http.Header) []byte {
+			h.Set(SignatureHeader, Sign("other secret", h, payload))
+			return payload
+		}, true},
+	}
+	for _, tt := range tests {
+		h := signed()
+		body := tt.tamper(h)
+		if err := Verify(testSecret, h, body, now, time.Minute); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Verify returned %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// a replayed callback is refused once it is older than the tolerance
+	if err := Verify(testSecret, signed(), payload, now.Add(10*time.Minute), time.Minute); err == nil {
+		t.Error("stale callback verified")
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		wantCalls   int
+		wantLetters int
+	}{
+		{"5xx retried", []int{http.StatusServiceUnavailable, http.StatusInternalServerError}, 3, 0},
+		{"5xx exhausted", []int{500, 500, 500, 500}, 3, 1},
+		{"4xx not retried", []int{http.StatusBadRequest}, 1, 1},
+		{"redirect not followed", []int{http.StatusFound}, 1, 1},
+	}
+	for _, tt := range tests {
+		rc := &receiver{statuses: tt.statuses}
+		server := httptest.NewServer(rc)
+		n, deadLetters := testNotifier(t, WebhookConfig{AllowPrivate: true})
+
+		n.Notify(testJob(server.URL))
+		rc.wait(tt.wantCalls)
+		n.Close()
+		server.Close()
+
+		if rc.count() != tt.wantCalls {
+			t.Errorf("%s: got %d attempts, want %d", tt.name, rc.count(), tt.wantCalls)
+		}
+		letters := deadLetters.List()
+		if len(letters) != tt.wantLetters {
+			t.Errorf("%s: got %d dead letters, want %d", tt.name, len(letters), tt.wantLetters)
+			continue
+		}
+		if tt.wantLetters > 0 && letters[0].Attempts != tt.wantCalls {
+			t.Errorf("%s: dead letter records %d attempts, want %d", tt.name, letters[0].Attempts, tt.wantCalls)
+		}
+	}
+}
+
+func TestDeliverBlocksPrivateAddresses(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	n, deadLetters := testNotifier(t, WebhookConfig{})
+
+	n.Notify(testJob(server.URL))
+	n.Close()
+
+	if rc.count() != 0 {
+		t.Errorf("callback reached %s", server.URL)
+	}
+	letters := deadLetters.List()
+	if len(letters) != 1 || letters[0].Attempts != 1 || !strings.Contains(letters[0].Error, errBlockedAddress.Error()) {
+		t.Errorf("unexpected dead letters %+v", letters)
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:10.0.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublic(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublic(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// TestCloseWaitsForDelivery checks Close returns only once callbacks in flight are done, and gives
+// up on retries rather than sleeping through them
+func TestCloseWaitsForDelivery(t *testing.T) {
+	release := make(chan struct{})
+	var calls int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		first := calls == 1
+		mu.Unlock()
+		if first {
+			<-release
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	deadLetters := NewMemoryDeadLetters(10)
+	n, err := NewNotifier(WebhookConfig{
+		Secret:       testSecret,
+		MaxAttempts:  5,
+		BaseDelay:    time.Hour,
+		Timeout:      5 * time.Second,
+		AllowPrivate: true,
+	}, deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Notify(testJob(server.URL))
+
+	closed := make(chan struct{})
+	go func() {
+		n.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a callback was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited through the retry delay")
+	}
+	if letters := deadLetters.List(); len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Errorf("unexpected dead letters %+v", letters)
+	}
+
+	// nothing is sent once closed
+	n.Notify(testJob(server.URL))
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("got %d callbacks, want 1", calls)
+	}
+}
+
+// TestDeliverUnknownEnvelope checks callbacks for rejected photos carry unknown in the body
+func TestDeliverUnknownEnvelope(t *testing.T) {
+	rc := &receiver{}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+	n, _ := testNotifier(t, WebhookConfig{AllowPrivate: true})
+
+	job := testJob(server.URL)
+	job.Predictions = nil
+	job.Unknown = &internal.Unknown{Rule: "entropy", Value: 0.9, Threshold: 0.8}
+	n.Notify(job)
+	n.Close()
+
+	if rc.count() != 1 {
+		t.Fatalf("got %d callbacks, want 1", rc.count())
+	}
+	var result internal.Result
+	if err := json.Unmarshal(rc.bodies[0], &result); err != nil {
+		t.Fatalf("callback is not the envelope: %v, %s", err, rc.bodies[0])
+	}
+	if result.Unknown == nil || result.Unknown.Rule != "entropy" || result.Predictions == nil {
+		t.Errorf("unexpected callback %s", rc.bodies[0])
+	}
+	if rc.requests[0].Header.Get(internal.UnknownHeader) != "true" {
+		t.Errorf("missing %s header", internal.UnknownHeader)
+	}
+}